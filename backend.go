@@ -8,6 +8,7 @@ import (
 	papi "github.com/murkyl/go-papi-lite"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,37 +17,89 @@ The OneFS secrets plugin for Vault allows dynamic creation and removal of S3 acc
 The plugin supports creation of role based access controls through integration with on cluster configuration.
 `
 const defaultUserRegexp string = "^%s_[^_]+_[^_]+_(?P<TimeStamp>[0-9]{14})$"
+const defaultUserInfRegexp string = "^%s_[^_]+_[^_]+_INF_[0-9]{14}$"
 
 type backend struct {
 	*framework.Backend
-	Conn        *papi.OnefsConn
-	NextCleanup time.Time
+	// papiSession is the session for the user in config/root
+	papiSession
+	// cfgLock is held while config/root is read, modified and written back by config writes, config deletes and
+	// root rotation so that none of them overwrites the changes of another
+	cfgLock sync.Mutex
+	// stateLock guards Cluster, NextCleanup and Status which are updated by requests and by the periodic function
+	stateLock sync.RWMutex
+	Cluster   clusterInfo
+	cache     backendCache
+	// limiter caps the number of concurrent PAPI operations. It is nil when there is no limit
+	limiter          *papiLimiter
+	limiterLock      sync.Mutex
+	Migration        *migrationStatus
+	NextCleanup      time.Time
+	Status           backendStatus
+	zoneSessions     map[string]*papiSession
+	zoneSessionsLock sync.Mutex
 }
 
 type backendCfg struct {
-	BypassCert     bool
-	CleanupPeriod  int
-	Endpoint       string
-	HomeDir        string
-	Password       string
-	PrimaryGroup   string
-	TTL            int
-	TTLMax         int
-	User           string
-	UsernamePrefix string
+	AllowedAccessZones    []string
+	AllowedGroups         []string
+	BypassCert            bool
+	CACert                string
+	CertFingerprints      []string
+	CleanupPeriod         int
+	ConnectTimeout        int
+	DeniedAccessZones     []string
+	DeniedGroups          []string
+	DenyUnlimitedTTL      bool
+	Endpoint              string
+	EndpointSelection     string
+	Endpoints             []string
+	HomeDir               string
+	IdleConnTimeout       int
+	LastRotation          time.Time
+	MaxConcurrentRequests int
+	MaxConnsPerHost       int
+	MaxIdleConns          int
+	MaxQueuedRequests     int
+	MaxRetries            int
+	Password              string
+	PasswordPolicy        string
+	PrimaryGroup          string
+	ProxyURL              string
+	QueueTimeout          int
+	RequestTimeout        int
+	RotationPeriod        int
+	SchemaVersion         int
+	StrictTTL             bool
+	TLSServerName         string
+	TTL                   int
+	TTLMax                int
+	User                  string
+	UsernamePrefix        string
 }
 
 var _ logical.Factory = Factory
 
 // Factory returns a Hashicorp Vault secrets backend object
 func Factory(ctx context.Context, cfg *logical.BackendConfig) (logical.Backend, error) {
-	b := &backend{}
+	b := &backend{papiSession: papiSession{activeEndpointIdx: -1}}
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeLogical,
 		Help:        strings.TrimSpace(backendHelp),
+		PathsSpecial: &logical.Paths{
+			// Entries containing credentials are seal wrapped when the seal supports it
+			SealWrapStorage: []string{
+				apiPathConfigRoot,
+				apiPathConfigZones,
+			},
+		},
 		Paths: framework.PathAppend(
 			pathConfigBuild(b),
 			pathConfigInfo(b),
+			pathConfigZonesBuild(b),
+			pathRotateRootBuild(b),
+			pathMaintenanceBuild(b),
+			pathStatusBuild(b),
 			pathRolesDynamicList(b),
 			pathRolesDynamicBuild(b),
 			pathRolesPredefinedList(b),
@@ -55,6 +108,7 @@ func Factory(ctx context.Context, cfg *logical.BackendConfig) (logical.Backend,
 			pathCredsPredefinedBuild(b),
 		),
 		InitializeFunc: b.pluginInit,
+		Invalidate:     b.pluginInvalidate,
 		PeriodicFunc:   b.pluginPeriod,
 		Clean:          b.pluginCleanup,
 	}
@@ -70,7 +124,12 @@ func (b *backend) pluginInit(ctx context.Context, req *logical.InitializationReq
 	if b.Conn == nil {
 		return fmt.Errorf("Failed to create a new PAPI connection")
 	}
-	return b.pluginReinit(ctx, req.Storage)
+	b.Migration = b.migrateStorage(ctx, req.Storage)
+	if err := b.pluginReinit(ctx, req.Storage); err != nil {
+		// A new connection is attempted automatically on the next API call
+		b.Logger().Warn(fmt.Sprintf("Unable to connect to endpoint during plugin creation: %s", err))
+	}
+	return nil
 }
 
 func (b *backend) pluginReinit(ctx context.Context, s logical.Storage) error {
@@ -82,78 +141,123 @@ func (b *backend) pluginReinit(ctx context.Context, s logical.Storage) error {
 		b.Logger().Info("No configuration found. Configure this plugin at the URL <plugin_path>/config/root")
 		return nil
 	}
-	b.NextCleanup = time.Now().Round(time.Second * time.Duration(cfg.CleanupPeriod))
-	if b.NextCleanup.Before(time.Now()) {
-		b.NextCleanup = b.NextCleanup.Add(time.Second * time.Duration(cfg.CleanupPeriod))
+	nextCleanup := time.Now().Round(time.Second * time.Duration(cfg.CleanupPeriod))
+	if nextCleanup.Before(time.Now()) {
+		nextCleanup = nextCleanup.Add(time.Second * time.Duration(cfg.CleanupPeriod))
 	}
-	err = b.Conn.Connect(&papi.OnefsCfg{
-		User:       cfg.User,
-		Password:   cfg.Password,
-		Endpoint:   cfg.Endpoint,
-		BypassCert: cfg.BypassCert,
-	})
-	if err != nil {
-		b.Logger().Info(fmt.Sprintf("Unable to connect to endpoint during plugin creation: %s", err))
-	}
-	return nil
+	b.setNextCleanup(nextCleanup)
+	// Access zone sessions use the connection settings in config/root and are created again on their next call
+	b.closeZoneSessions()
+	b.papiSession.lock.Lock()
+	defer b.papiSession.lock.Unlock()
+	return b.connect(ctx, &b.papiSession, cfg)
 }
 
 func (b *backend) pluginPeriod(ctx context.Context, req *logical.Request) error {
-	cfg, err := getCfgFromStorage(ctx, req.Storage)
+	cfg, err := b.getCfg(ctx, req.Storage)
 	if err != nil || cfg == nil {
 		return nil
 	}
+	b.pluginPeriodHealthCheck(ctx, req.Storage, cfg)
+	b.pluginPeriodKeepAlive(ctx, cfg)
+	b.pluginPeriodRotateRoot(ctx, req.Storage, cfg)
 	// Wait until we have a valid config
 	if cfg.CleanupPeriod <= 0 {
 		return nil
 	}
 	// Use the stored last cleanup time and only after the configured cleanup time is exceeded do we query all users and perform cleanup
 	curTime := time.Now()
-	if curTime.After(b.NextCleanup) {
-		// We purposely update the next cleanup time immediately in case a cleanup error occurs. This will prevent
-		// cleanup from running each time pluginPeriod is called
-		timeDiff := time.Now().Sub(b.NextCleanup).Truncate(time.Second * time.Duration(cfg.CleanupPeriod))
-		b.NextCleanup = b.NextCleanup.Add(timeDiff).Add(time.Second * time.Duration(cfg.CleanupPeriod))
-
-		rex := regexp.MustCompile(fmt.Sprintf(defaultUserRegexp, cfg.UsernamePrefix))
-		zones, err := b.getActiveAccessZonesFromRoles(ctx, req.Storage, cfg.UsernamePrefix)
+	if b.cleanupDue(curTime, cfg.CleanupPeriod) {
+		deleted, errCount, err := b.cleanupExpiredUsers(ctx, req.Storage, cfg, curTime)
+		b.recordCleanup(curTime, deleted, errCount, err)
 		if err != nil {
 			return err
 		}
-		// Get a list of all users in the access zone
-		for zoneName := range zones {
-			userList, err := b.Conn.GetUserList(zoneName)
-			if err != nil {
-				b.Logger().Error(fmt.Sprintf("[pluginPeriod] Unable to get user list for access zone: %s", zoneName))
-				continue
-			}
-			for _, user := range userList {
-				// Regex match each user name to determine which users are created by this plugin
-				result := rex.FindAllStringSubmatch(user.Name, -1)
-				if result != nil {
-					// If the user name matches, we need to parse the expiration timestamp from the user name and compare it to the current time
-					expireTime, err := time.ParseInLocation(defaultPathCredsDynamicTimeFormat, result[0][1], time.Local)
+	}
+	return nil
+}
+
+// cleanupDue returns true when the next cleanup time has passed. The next cleanup time is advanced immediately, even
+// when the cleanup fails, so that cleanup does not run each time pluginPeriod is called
+func (b *backend) cleanupDue(curTime time.Time, cleanupPeriod int) bool {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if !curTime.After(b.NextCleanup) {
+		return false
+	}
+	timeDiff := curTime.Sub(b.NextCleanup).Truncate(time.Second * time.Duration(cleanupPeriod))
+	b.NextCleanup = b.NextCleanup.Add(timeDiff).Add(time.Second * time.Duration(cleanupPeriod))
+	return true
+}
+
+// setNextCleanup sets the time of the next cleanup of expired users
+func (b *backend) setNextCleanup(nextCleanup time.Time) {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	b.NextCleanup = nextCleanup
+}
+
+// cleanupExpiredUsers deletes the dynamic users in every access zone used by a role whose expiration time has passed.
+// The number of deleted users and the number of errors are returned
+func (b *backend) cleanupExpiredUsers(ctx context.Context, s logical.Storage, cfg *backendCfg, curTime time.Time) (int, int, error) {
+	deleted := 0
+	errCount := 0
+	zones, err := b.getActiveAccessZonesFromRoles(ctx, s, cfg.UsernamePrefix)
+	if err != nil {
+		return deleted, errCount, err
+	}
+	// Get a list of all users in the access zone
+	for zoneName := range zones {
+		prefixes, err := getZoneUsernamePrefixes(ctx, s, cfg, zoneName)
+		if err != nil {
+			return deleted, errCount, err
+		}
+		rex := usernameRegexp(defaultUserRegexp, prefixes)
+		var userList []string
+		err = b.papiDoZone(ctx, s, cfg, zoneName, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+			var err error
+			userList, err = papiGetUserNames(conn, zoneName)
+			return err
+		})
+		if err != nil {
+			b.Logger().Error(fmt.Sprintf("[pluginPeriod] Unable to get user list for access zone: %s", zoneName))
+			errCount++
+			continue
+		}
+		for _, userName := range userList {
+			// Regex match each user name to determine which users are created by this plugin
+			result := rex.FindAllStringSubmatch(userName, -1)
+			if result != nil {
+				// If the user name matches, we need to parse the expiration timestamp from the user name and compare it to the current time
+				expireTime, err := time.ParseInLocation(defaultPathCredsDynamicTimeFormat, result[0][1], time.Local)
+				if err != nil {
+					return deleted, errCount, err
+				}
+				// If expireTime is earlier than our current time then this user has expired
+				if expireTime.Before(curTime) {
+					err := b.papiDoZone(ctx, s, cfg, zoneName, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+						return papiDeleteUser(conn, userName, zoneName)
+					})
 					if err != nil {
-						return err
-					}
-					// If expireTime is earlier than our current time then this user has expired
-					if expireTime.Before(curTime) {
-						_, err := b.Conn.DeleteUser(user.Name, zoneName)
-						if err != nil {
-							b.Logger().Error(fmt.Sprintf("[pluginPeriod] Unable to delete user %s for access zone: %s", user.Name, zoneName))
-						}
+						b.Logger().Error(fmt.Sprintf("[pluginPeriod] Unable to delete user %s for access zone: %s", userName, zoneName))
+						errCount++
+						continue
 					}
+					deleted++
 				}
 			}
 		}
 	}
-	return nil
+	return deleted, errCount, nil
 }
 
 func (b *backend) pluginCleanup(ctx context.Context) {
+	b.papiSession.lock.Lock()
 	if b.Conn != nil {
 		b.Conn.Disconnect()
 	}
+	b.papiSession.lock.Unlock()
+	b.closeZoneSessions()
 }
 
 // getActiveAccessZonesFromRoles searches all configured roles and returns a list of access zones that have users
@@ -175,3 +279,63 @@ func (b *backend) getActiveAccessZonesFromRoles(ctx context.Context, s logical.S
 	}
 	return azones, nil
 }
+
+// getDynamicUsers searches every access zone on the cluster and returns the names of users created by this plugin.
+// The map key is the user name and the value is the access zone of the user
+func (b *backend) getDynamicUsers(ctx context.Context, s logical.Storage, cfg *backendCfg) (map[string]string, error) {
+	var zoneList []string
+	err := b.papiDo(ctx, cfg, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+		var err error
+		zoneList, err = papiGetAccessZoneNames(conn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	users := map[string]string{}
+	for _, zoneName := range zoneList {
+		prefixes, err := getZoneUsernamePrefixes(ctx, s, cfg, zoneName)
+		if err != nil {
+			return nil, err
+		}
+		rex := usernameRegexp(defaultUserRegexp, prefixes)
+		rexInf := usernameRegexp(defaultUserInfRegexp, prefixes)
+		var userList []string
+		err = b.papiDoZone(ctx, s, cfg, zoneName, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+			var err error
+			userList, err = papiGetUserNames(conn, zoneName)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, userName := range userList {
+			if rex.MatchString(userName) || rexInf.MatchString(userName) {
+				users[userName] = zoneName
+			}
+		}
+	}
+	return users, nil
+}
+
+// getZoneUsernamePrefixes returns the user name prefixes of dynamic users in an access zone. Users created before an
+// access zone override was configured use the prefix from the plugin configuration so both prefixes are returned
+func getZoneUsernamePrefixes(ctx context.Context, s logical.Storage, cfg *backendCfg, zoneName string) ([]string, error) {
+	zone, err := getZoneDefaults(ctx, s, cfg, zoneName)
+	if err != nil {
+		return nil, err
+	}
+	if zone.UsernamePrefix == cfg.UsernamePrefix {
+		return []string{cfg.UsernamePrefix}, nil
+	}
+	return []string{zone.UsernamePrefix, cfg.UsernamePrefix}, nil
+}
+
+// usernameRegexp builds a regular expression from one of the dynamic user name formats that matches any of the prefixes
+func usernameRegexp(format string, prefixes []string) *regexp.Regexp {
+	quoted := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		quoted[i] = regexp.QuoteMeta(prefix)
+	}
+	return regexp.MustCompile(fmt.Sprintf(format, "(?:"+strings.Join(quoted, "|")+")"))
+}
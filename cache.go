@@ -0,0 +1,146 @@
+package vaultonefs
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"strings"
+	"sync"
+)
+
+// backendCache holds the configuration and roles read from storage. Entries are removed by the handlers that write
+// them and by Invalidate when another node of the Vault cluster changes them. Cached values are copied before they
+// are returned, including their slices, so a handler can modify the value it receives
+type backendCache struct {
+	lock            sync.Mutex
+	cfg             *backendCfg
+	dynamicRoles    map[string]*s3Role
+	predefinedRoles map[string]*s3PredefinedRole
+}
+
+// getCfg returns the plugin configuration from the cache, reading it from storage when it is not cached. The lock is
+// held while storage is read so that a concurrent write cannot be overwritten by an older value
+func (b *backend) getCfg(ctx context.Context, s logical.Storage) (*backendCfg, error) {
+	b.cache.lock.Lock()
+	defer b.cache.lock.Unlock()
+	if b.cache.cfg == nil {
+		cfg, err := getCfgFromStorage(ctx, s)
+		if err != nil || cfg == nil {
+			return nil, err
+		}
+		b.cache.cfg = cfg
+	}
+	return b.cache.cfg.copy(), nil
+}
+
+// getDynamicRole returns a dynamic role from the cache, reading it from storage when it is not cached
+func (b *backend) getDynamicRole(ctx context.Context, s logical.Storage, roleName string) (*s3Role, error) {
+	b.cache.lock.Lock()
+	defer b.cache.lock.Unlock()
+	role, ok := b.cache.dynamicRoles[roleName]
+	if !ok {
+		var err error
+		role, err = getDynamicRoleFromStorage(ctx, s, roleName)
+		if err != nil || role == nil {
+			return nil, err
+		}
+		if b.cache.dynamicRoles == nil {
+			b.cache.dynamicRoles = map[string]*s3Role{}
+		}
+		b.cache.dynamicRoles[roleName] = role
+	}
+	return role.copy(), nil
+}
+
+// getPredefinedRole returns a predefined role from the cache, reading it from storage when it is not cached
+func (b *backend) getPredefinedRole(ctx context.Context, s logical.Storage, roleName string) (*s3PredefinedRole, error) {
+	b.cache.lock.Lock()
+	defer b.cache.lock.Unlock()
+	role, ok := b.cache.predefinedRoles[roleName]
+	if !ok {
+		var err error
+		role, err = getPredefinedRoleFromStorage(ctx, s, roleName)
+		if err != nil || role == nil {
+			return nil, err
+		}
+		if b.cache.predefinedRoles == nil {
+			b.cache.predefinedRoles = map[string]*s3PredefinedRole{}
+		}
+		b.cache.predefinedRoles[roleName] = role
+	}
+	roleCopy := *role
+	return &roleCopy, nil
+}
+
+// copy returns a copy of the configuration that shares no slices with the original
+func (cfg *backendCfg) copy() *backendCfg {
+	cfgCopy := *cfg
+	cfgCopy.AllowedAccessZones = copyStrings(cfg.AllowedAccessZones)
+	cfgCopy.AllowedGroups = copyStrings(cfg.AllowedGroups)
+	cfgCopy.CertFingerprints = copyStrings(cfg.CertFingerprints)
+	cfgCopy.DeniedAccessZones = copyStrings(cfg.DeniedAccessZones)
+	cfgCopy.DeniedGroups = copyStrings(cfg.DeniedGroups)
+	cfgCopy.Endpoints = copyStrings(cfg.Endpoints)
+	return &cfgCopy
+}
+
+// copy returns a copy of the role that shares no slices with the original
+func (role *s3Role) copy() *s3Role {
+	roleCopy := *role
+	roleCopy.Groups = copyStrings(role.Groups)
+	return &roleCopy
+}
+
+// copyStrings returns a copy of a string slice. A nil slice stays nil
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string{}, values...)
+}
+
+// clearCache removes the cached value for a storage key. Keys that are not cached are ignored
+func (b *backend) clearCache(key string) {
+	b.cache.lock.Lock()
+	defer b.cache.lock.Unlock()
+	switch {
+	case key == apiPathConfigRoot:
+		b.cache.cfg = nil
+	case strings.HasPrefix(key, apiPathRolesDynamic):
+		delete(b.cache.dynamicRoles, strings.TrimPrefix(key, apiPathRolesDynamic))
+	case strings.HasPrefix(key, apiPathRolesPredefined):
+		delete(b.cache.predefinedRoles, strings.TrimPrefix(key, apiPathRolesPredefined))
+	}
+}
+
+// pluginInvalidate is called on performance standbys and secondaries when a replicated storage key changes. Cached
+// values are dropped and the sessions that depend on the changed configuration are closed. The next request connects
+// again with the new configuration
+func (b *backend) pluginInvalidate(ctx context.Context, key string) {
+	b.clearCache(key)
+	switch {
+	case key == apiPathConfigRoot:
+		b.Logger().Info("The plugin configuration changed, closing the PAPI sessions")
+		b.resetSession(&b.papiSession)
+		b.closeZoneSessions()
+	case strings.HasPrefix(key, apiPathConfigZones):
+		zoneName := strings.TrimPrefix(key, apiPathConfigZones)
+		b.Logger().Info(fmt.Sprintf("The configuration of access zone %s changed, closing its PAPI session", zoneName))
+		b.closeZoneSessions(zoneName)
+	}
+}
+
+// resetSession disconnects a session and replaces its connection with an unconnected one. A new connection is made
+// on the next call that uses the session
+func (b *backend) resetSession(sess *papiSession) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if sess.Conn != nil {
+		sess.Conn.Disconnect()
+	}
+	sess.Conn = papi.NewPapiConn()
+	sess.ActiveEndpoint = ""
+	sess.activeEndpointIdx = -1
+	sess.generation++
+}
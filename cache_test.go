@@ -0,0 +1,73 @@
+package vaultonefs
+
+import (
+	"context"
+	"github.com/hashicorp/vault/sdk/logical"
+	"testing"
+)
+
+func TestCacheInvalidate(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	b := newTestBackend()
+	HelperPutRaw(t, s, apiPathConfigRoot, `{"User":"vault_mgr","SchemaVersion":1}`)
+	HelperPutRaw(t, s, apiPathRolesDynamic+"role1", `{"Bucket":"b1","SchemaVersion":1}`)
+	HelperCachedValues(t, b, s, "vault_mgr", "b1")
+
+	// Changes made by another node are not seen until the key is invalidated
+	HelperPutRaw(t, s, apiPathConfigRoot, `{"User":"vault_admin","SchemaVersion":1}`)
+	HelperPutRaw(t, s, apiPathRolesDynamic+"role1", `{"Bucket":"b2","SchemaVersion":1}`)
+	HelperCachedValues(t, b, s, "vault_mgr", "b1")
+	b.ActiveEndpoint = "https://node1:8080"
+	oldConn := b.Conn
+	b.pluginInvalidate(ctx, apiPathConfigRoot)
+	b.pluginInvalidate(ctx, apiPathRolesDynamic+"role1")
+	HelperCachedValues(t, b, s, "vault_admin", "b2")
+	if b.Conn == oldConn || b.ActiveEndpoint != "" || b.activeEndpointIdx != -1 {
+		t.Errorf("Expected the session to be reset after the configuration changed")
+	}
+
+	// Values returned by the cache are copies
+	cfg, _ := b.getCfg(ctx, s)
+	cfg.User = "modified"
+	HelperCachedValues(t, b, s, "vault_admin", "b2")
+}
+
+func TestCacheCopiesSlices(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	b := newTestBackend()
+	HelperPutRaw(t, s, apiPathConfigRoot, `{"Endpoints":["https://node1:8080"],"DeniedGroups":["Administrators"],"SchemaVersion":2}`)
+	HelperPutRaw(t, s, apiPathRolesDynamic+"role1", `{"Groups":["g1"],"SchemaVersion":2}`)
+	cfg, _ := b.getCfg(ctx, s)
+	cfg.Endpoints[0] = "https://modified:8080"
+	cfg.DeniedGroups[0] = "modified"
+	role, _ := b.getDynamicRole(ctx, s, "role1")
+	role.Groups[0] = "modified"
+	cfg, _ = b.getCfg(ctx, s)
+	if cfg.Endpoints[0] != "https://node1:8080" || cfg.DeniedGroups[0] != "Administrators" {
+		t.Errorf("Expected the cached configuration to be unchanged, Got: %v %v", cfg.Endpoints, cfg.DeniedGroups)
+	}
+	role, _ = b.getDynamicRole(ctx, s, "role1")
+	if role.Groups[0] != "g1" {
+		t.Errorf("Expected the cached role to be unchanged, Got: %v", role.Groups)
+	}
+}
+
+func HelperCachedValues(t *testing.T, b *backend, s logical.Storage, user string, bucket string) {
+	ctx := context.Background()
+	cfg, err := b.getCfg(ctx, s)
+	if err != nil || cfg == nil {
+		t.Fatalf("Unable to read config: %v", err)
+	}
+	if cfg.User != user {
+		t.Errorf("Expected user: %s, Got: %s", user, cfg.User)
+	}
+	role, err := b.getDynamicRole(ctx, s, "role1")
+	if err != nil || role == nil {
+		t.Fatalf("Unable to read role: %v", err)
+	}
+	if role.Bucket != bucket {
+		t.Errorf("Expected bucket: %s, Got: %s", bucket, role.Bucket)
+	}
+}
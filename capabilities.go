@@ -0,0 +1,120 @@
+package vaultonefs
+
+import (
+	"context"
+	"fmt"
+	papi "github.com/murkyl/go-papi-lite"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	capabilityS3          string = "s3"
+	capabilityS3KeyExpiry string = "s3_key_expiry"
+)
+
+// onefsCapability describes a feature of the OneFS API used by the plugin and the first PAPI version that supports it
+type onefsCapability struct {
+	Name           string
+	Description    string
+	MinPapiVersion int
+	MinRelease     string
+}
+
+// onefsCapabilities lists the features the plugin depends on. The PAPI version increases with every OneFS release so
+// it is used to decide which features are available
+var onefsCapabilities = []onefsCapability{
+	{Name: capabilityS3, Description: "S3 access keys", MinPapiVersion: 11, MinRelease: "9.0"},
+	{Name: capabilityS3KeyExpiry, Description: "S3 access key expiry", MinPapiVersion: 11, MinRelease: "9.0"},
+}
+
+// clusterInfo holds the identity and versions of the cluster detected when a session is created
+type clusterInfo struct {
+	GUID         string
+	Name         string
+	OnefsVersion string
+	PapiVersion  int
+	Detected     time.Time
+}
+
+// ParsePapiVersion returns the major PAPI version from a platform path or a version string such as "12" or "12.1".
+// A value of 0 is returned when the version cannot be parsed
+func ParsePapiVersion(version string) int {
+	version = strings.TrimPrefix(version, "platform/")
+	if idx := strings.Index(version, "."); idx >= 0 {
+		version = version[:idx]
+	}
+	major, err := strconv.Atoi(version)
+	if err != nil || major < 0 {
+		return 0
+	}
+	return major
+}
+
+// Capabilities returns whether each feature in onefsCapabilities is supported by a PAPI version
+func Capabilities(papiVersion int) map[string]bool {
+	caps := map[string]bool{}
+	for _, capability := range onefsCapabilities {
+		caps[capability.Name] = papiVersion >= capability.MinPapiVersion
+	}
+	return caps
+}
+
+// CheckCapability returns an error when the detected PAPI version does not support a feature. No error is returned
+// when the version has not been detected yet so that an unknown version never blocks a request
+func CheckCapability(name string, info clusterInfo) error {
+	if info.PapiVersion == 0 {
+		return nil
+	}
+	for _, capability := range onefsCapabilities {
+		if capability.Name != name {
+			continue
+		}
+		if info.PapiVersion >= capability.MinPapiVersion {
+			return nil
+		}
+		running := fmt.Sprintf("PAPI version %d", info.PapiVersion)
+		if info.OnefsVersion != "" {
+			running = fmt.Sprintf("OneFS %s (%s)", info.OnefsVersion, running)
+		}
+		return fmt.Errorf("%s requires OneFS %s or later (PAPI version %d). The cluster runs %s", capability.Description, capability.MinRelease, capability.MinPapiVersion, running)
+	}
+	return fmt.Errorf("Unknown capability %s", name)
+}
+
+// detectClusterInfo reads the PAPI version of a connected session along with the cluster identity and OneFS version.
+// The cluster configuration is optional as a user with limited privileges may not be able to read it
+func (b *backend) detectClusterInfo(ctx context.Context, conn *papi.OnefsConn) {
+	info := clusterInfo{
+		PapiVersion: ParsePapiVersion(conn.PlatformPath),
+		Detected:    time.Now(),
+	}
+	clusterCfg, err := papiGetClusterConfig(papiWithContext(ctx, conn))
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if err != nil {
+		b.Logger().Debug(fmt.Sprintf("Unable to read the cluster configuration: %s", err))
+		if b.Cluster.GUID != "" {
+			// Keep the identity detected by an earlier session
+			info.GUID = b.Cluster.GUID
+			info.Name = b.Cluster.Name
+			info.OnefsVersion = b.Cluster.OnefsVersion
+		}
+	} else {
+		info.GUID = clusterCfg.GUID
+		info.Name = clusterCfg.Name
+		info.OnefsVersion = clusterCfg.OnefsVersion.Release
+	}
+	if b.Cluster.PapiVersion != 0 && b.Cluster.PapiVersion != info.PapiVersion {
+		b.Logger().Info(fmt.Sprintf("PAPI version changed from %d to %d", b.Cluster.PapiVersion, info.PapiVersion))
+	}
+	b.Cluster = info
+}
+
+// getClusterInfo returns a copy of the cluster identity and versions detected by the last session created
+func (b *backend) getClusterInfo() clusterInfo {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	return b.Cluster
+}
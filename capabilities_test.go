@@ -0,0 +1,44 @@
+package vaultonefs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePapiVersion(t *testing.T) {
+	HelperParsePapiVersion(t, "platform/12", 12)
+	HelperParsePapiVersion(t, "9", 9)
+	HelperParsePapiVersion(t, "16.1", 16)
+	HelperParsePapiVersion(t, "", 0)
+	HelperParsePapiVersion(t, "platform/latest", 0)
+}
+
+func TestCheckCapability(t *testing.T) {
+	HelperCheckCapability(t, capabilityS3, clusterInfo{}, "")
+	HelperCheckCapability(t, capabilityS3, clusterInfo{PapiVersion: 12}, "")
+	HelperCheckCapability(t, capabilityS3, clusterInfo{PapiVersion: 11, OnefsVersion: "9.0.0.0"}, "")
+	HelperCheckCapability(t, capabilityS3, clusterInfo{PapiVersion: 10, OnefsVersion: "8.2.2.0"}, "requires OneFS 9.0 or later (PAPI version 11)")
+	HelperCheckCapability(t, capabilityS3KeyExpiry, clusterInfo{PapiVersion: 10, OnefsVersion: "8.2.2.0"}, "requires OneFS 9.0 or later")
+	HelperCheckCapability(t, capabilityS3KeyExpiry, clusterInfo{PapiVersion: 10, OnefsVersion: "8.2.2.0"}, "OneFS 8.2.2.0 (PAPI version 10)")
+	HelperCheckCapability(t, "snapshots", clusterInfo{PapiVersion: 12}, "Unknown capability")
+}
+
+func HelperParsePapiVersion(t *testing.T, version string, expected int) {
+	x := ParsePapiVersion(version)
+	if x != expected {
+		t.Errorf("Version: %s, Expected: %d, Got: %d", version, expected, x)
+	}
+}
+
+func HelperCheckCapability(t *testing.T, name string, info clusterInfo, expected string) {
+	err := CheckCapability(name, info)
+	if expected == "" {
+		if err != nil {
+			t.Errorf("Capability: %s, PAPI version: %d, Expected no error, Got: %s", name, info.PapiVersion, err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("Capability: %s, PAPI version: %d, Expected error containing '%s', Got: %v", name, info.PapiVersion, expected, err)
+	}
+}
@@ -0,0 +1,187 @@
+package vaultonefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	endpointSelectionPriority   string = "priority"
+	endpointSelectionRoundRobin string = "round_robin"
+	endpointHealthCheckTimeout  int    = 10
+)
+
+// EndpointList returns the configured endpoints in priority order. The endpoint field is used when no list of
+// endpoints is configured
+func (cfg *backendCfg) EndpointList() []string {
+	if len(cfg.Endpoints) > 0 {
+		return cfg.Endpoints
+	}
+	if cfg.Endpoint != "" {
+		return []string{cfg.Endpoint}
+	}
+	return nil
+}
+
+// EndpointOrder returns the indexes of the endpoints in the order they should be tried. With priority selection the
+// order is always the configured order. With round robin selection the order starts with the endpoint after the
+// last one used
+func EndpointOrder(count int, selection string, last int) []int {
+	if selection == endpointSelectionRoundRobin && last >= 0 {
+		return EndpointOrderFrom(count, last+1)
+	}
+	return EndpointOrderFrom(count, 0)
+}
+
+// EndpointOrderFrom returns the indexes of all the endpoints starting with the first index and wrapping around
+func EndpointOrderFrom(count int, first int) []int {
+	order := make([]int, 0, count)
+	if first < 0 {
+		first = 0
+	}
+	for i := 0; i < count; i++ {
+		order = append(order, (first+i)%count)
+	}
+	return order
+}
+
+// connectEndpoints tries each endpoint in order until a session is created. The index of the connected endpoint is
+// returned. When every endpoint fails the error contains the reason for each endpoint
+func connectEndpoints(ctx context.Context, conn *papi.OnefsConn, cfg *backendCfg, order []int) (int, error) {
+	endpoints := cfg.EndpointList()
+	if len(endpoints) == 0 {
+		return -1, fmt.Errorf("No endpoint configured")
+	}
+	var errs []error
+	for _, idx := range order {
+		epCfg := *cfg
+		epCfg.Endpoint = endpoints[idx]
+		err := papiConnect(ctx, conn, &epCfg)
+		if err == nil {
+			return idx, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return -1, errs[0]
+	}
+	return -1, fmt.Errorf("Unable to connect to any endpoint:\n%w", errors.Join(errs...))
+}
+
+// connect connects a session to one of the configured endpoints and records the active endpoint
+func (b *backend) connect(ctx context.Context, sess *papiSession, cfg *backendCfg) error {
+	return b.connectOrder(ctx, sess, cfg, EndpointOrder(len(cfg.EndpointList()), cfg.EndpointSelection, sess.activeEndpointIdx))
+}
+
+// reconnect creates a new session on the active endpoint. The remaining endpoints are tried if the active endpoint
+// cannot be reached
+func (b *backend) reconnect(ctx context.Context, sess *papiSession, cfg *backendCfg) error {
+	return b.connectOrder(ctx, sess, cfg, EndpointOrderFrom(len(cfg.EndpointList()), sess.activeEndpointIdx))
+}
+
+// connectOrder tries the endpoints in the given order and records the endpoint that was connected. A closed session is
+// not connected. The caller must hold the write lock of the session
+func (b *backend) connectOrder(ctx context.Context, sess *papiSession, cfg *backendCfg, order []int) error {
+	if sess.closed {
+		return logical.CodedError(http.StatusServiceUnavailable, fmt.Sprintf("The session for user %s was closed as the configuration changed, retry the request", cfg.User))
+	}
+	endpoints := cfg.EndpointList()
+	sess.generation++
+	idx, err := connectEndpoints(ctx, sess.Conn, cfg, order)
+	b.recordPapiResult(err)
+	if err != nil {
+		sess.ActiveEndpoint = ""
+		return err
+	}
+	if sess.ActiveEndpoint != "" && sess.ActiveEndpoint != endpoints[idx] {
+		b.Logger().Warn(fmt.Sprintf("Switched PAPI endpoint for user %s from %s to %s", cfg.User, sess.ActiveEndpoint, endpoints[idx]))
+	}
+	sess.activeEndpointIdx = idx
+	sess.ActiveEndpoint = endpoints[idx]
+	b.detectClusterInfo(ctx, sess.Conn)
+	return nil
+}
+
+// endpointHealthy checks that an endpoint responds to HTTP requests. Any response below 500 is considered healthy as
+// the request is made without a session and the endpoint is expected to reject it
+func endpointHealthy(ctx context.Context, cfg *backendCfg, endpoint string) bool {
+	transport, err := newPapiTransport(cfg)
+	if err != nil {
+		return false
+	}
+	client := &http.Client{
+		Timeout:   time.Duration(endpointHealthCheckTimeout) * time.Second,
+		Transport: transport,
+	}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(endpoint, "/")+"/"+papiSessionPath, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// pluginPeriodHealthCheck checks the active endpoint of the session for config/root and of every access zone session
+// and reconnects to another endpoint when it is unhealthy. With priority selection the connections fail back to a
+// higher priority endpoint once it is healthy again. Access zone sessions that have not connected yet are left alone
+// as they connect on their next call
+func (b *backend) pluginPeriodHealthCheck(ctx context.Context, s logical.Storage, cfg *backendCfg) {
+	b.healthCheckSession(ctx, &b.papiSession, cfg, true)
+	for zoneName, sess := range b.zoneSessionList() {
+		zone, err := getZoneCfgFromStorage(ctx, s, zoneName)
+		if err != nil {
+			b.Logger().Error(fmt.Sprintf("[pluginPeriodHealthCheck] Unable to read the configuration of access zone %s: %s", zoneName, err))
+			continue
+		}
+		if zone == nil || zone.User == "" {
+			continue
+		}
+		b.healthCheckSession(ctx, sess, cfg.ZoneConnCfg(zone), false)
+	}
+}
+
+// healthCheckSession reconnects a session when its active endpoint is unhealthy or, with priority selection, when a
+// higher priority endpoint is healthy. A session without an active endpoint is only connected when connectIdle is set
+func (b *backend) healthCheckSession(ctx context.Context, sess *papiSession, cfg *backendCfg, connectIdle bool) {
+	endpoints := cfg.EndpointList()
+	if len(endpoints) < 2 {
+		return
+	}
+	activeEndpoint, activeEndpointIdx := sess.endpoint()
+	if activeEndpoint == "" && !connectIdle {
+		return
+	}
+	reconnect := activeEndpoint == "" || !endpointHealthy(ctx, cfg, activeEndpoint)
+	if !reconnect && cfg.EndpointSelection != endpointSelectionRoundRobin {
+		for i := 0; i < activeEndpointIdx && i < len(endpoints); i++ {
+			if endpointHealthy(ctx, cfg, endpoints[i]) {
+				reconnect = true
+				break
+			}
+		}
+	}
+	if !reconnect {
+		return
+	}
+	sess.lock.Lock()
+	if sess.closed {
+		sess.lock.Unlock()
+		return
+	}
+	err := b.connect(ctx, sess, cfg)
+	sess.lock.Unlock()
+	if err != nil {
+		b.Logger().Error(fmt.Sprintf("[pluginPeriodHealthCheck] Unable to connect to any endpoint for user %s: %s", cfg.User, err))
+	}
+}
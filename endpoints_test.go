@@ -0,0 +1,73 @@
+package vaultonefs
+
+import (
+	"context"
+	"github.com/hashicorp/vault/sdk/logical"
+	"reflect"
+	"testing"
+)
+
+func TestEndpointOrder(t *testing.T) {
+	//                 Count Selection Last Expected
+	HelperEndpointOrder(t, 3, endpointSelectionPriority, -1, []int{0, 1, 2})
+	HelperEndpointOrder(t, 3, endpointSelectionPriority, 1, []int{0, 1, 2})
+	HelperEndpointOrder(t, 3, endpointSelectionRoundRobin, -1, []int{0, 1, 2})
+	HelperEndpointOrder(t, 3, endpointSelectionRoundRobin, 0, []int{1, 2, 0})
+	HelperEndpointOrder(t, 3, endpointSelectionRoundRobin, 2, []int{0, 1, 2})
+	HelperEndpointOrder(t, 1, endpointSelectionRoundRobin, 0, []int{0})
+	HelperEndpointOrder(t, 0, endpointSelectionRoundRobin, -1, []int{})
+}
+
+func TestEndpointList(t *testing.T) {
+	HelperEndpointList(t, &backendCfg{}, nil)
+	HelperEndpointList(t, &backendCfg{Endpoint: "https://a:8080"}, []string{"https://a:8080"})
+	HelperEndpointList(t, &backendCfg{Endpoint: "https://a:8080", Endpoints: []string{"https://b:8080", "https://c:8080"}}, []string{"https://b:8080", "https://c:8080"})
+}
+
+func TestPluginPeriodHealthCheckZoneSessions(t *testing.T) {
+	ctx := context.Background()
+	f1 := newFakePapi()
+	defer f1.server.Close()
+	f2 := newFakePapi()
+	defer f2.server.Close()
+	b := newTestBackend()
+	s := &logical.InmemStorage{}
+	cfg := &backendCfg{Endpoint: f1.server.URL, User: "vault_mgr", Password: "secret"}
+	for _, zoneName := range []string{"zone1", "zone2"} {
+		entry, _ := logical.StorageEntryJSON(apiPathConfigZones+zoneName, &zoneCfg{User: "zone_mgr", Password: "secret", Endpoints: []string{f1.server.URL, f2.server.URL}})
+		if err := s.Put(ctx, entry); err != nil {
+			t.Fatalf("Unable to store access zone config: %s", err)
+		}
+	}
+	// The session of zone1 failed over to the second endpoint while the first endpoint was unavailable
+	sess := b.zoneSession("zone1")
+	zone, _ := getZoneCfgFromStorage(ctx, s, "zone1")
+	sess.lock.Lock()
+	err := b.connectOrder(ctx, sess, cfg.ZoneConnCfg(zone), []int{1})
+	sess.lock.Unlock()
+	if err != nil {
+		t.Fatalf("Unable to connect the access zone session: %s", err)
+	}
+	idle := b.zoneSession("zone2")
+	b.pluginPeriodHealthCheck(ctx, s, cfg)
+	if endpoint, _ := sess.endpoint(); endpoint != f1.server.URL {
+		t.Errorf("Expected the access zone session to fail back to %s, Got: %s", f1.server.URL, endpoint)
+	}
+	if idle.connected() {
+		t.Errorf("Expected an access zone session that has not connected yet to be left alone")
+	}
+}
+
+func HelperEndpointOrder(t *testing.T, count int, selection string, last int, expected []int) {
+	x := EndpointOrder(count, selection, last)
+	if !reflect.DeepEqual(x, expected) {
+		t.Errorf("Count: %d, Selection: %s, Last: %d, Expected: %v, Got: %v", count, selection, last, expected, x)
+	}
+}
+
+func HelperEndpointList(t *testing.T, cfg *backendCfg, expected []string) {
+	x := cfg.EndpointList()
+	if !reflect.DeepEqual(x, expected) {
+		t.Errorf("Endpoint: %s, Endpoints: %v, Expected: %v, Got: %v", cfg.Endpoint, cfg.Endpoints, expected, x)
+	}
+}
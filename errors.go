@@ -0,0 +1,121 @@
+package vaultonefs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPapiMaxRetries int = 3
+	// papiRetryBaseDelay and papiRetryMaxDelay bound the backoff between retries in milliseconds
+	papiRetryBaseDelay int = 250
+	papiRetryMaxDelay  int = 5000
+)
+
+// papiError is an error response returned by the cluster
+type papiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// parsePapiError returns the HTTP status and the first error code and message in the body of an error returned by
+// papiSend. Nil is returned when the error is not an error response from the cluster
+func parsePapiError(err error) *papiError {
+	var respErr *papiResponseError
+	if !errors.As(err, &respErr) {
+		return nil
+	}
+	result := &papiError{Status: respErr.Status}
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal([]byte(strings.TrimSpace(respErr.Body)), &body) == nil && len(body.Errors) > 0 {
+		result.Code = body.Errors[0].Code
+		result.Message = body.Errors[0].Message
+	}
+	return result
+}
+
+// IsPapiTransientError returns true for errors that may succeed when the call is repeated. These are requests that
+// received no response, 429 responses and 5xx responses. Cancelled requests are never transient
+func IsPapiTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if IsPapiSendError(err) {
+		return true
+	}
+	if pErr := parsePapiError(err); pErr != nil {
+		return pErr.Status == http.StatusTooManyRequests || pErr.Status >= 500
+	}
+	return false
+}
+
+// papiRetryDelay returns the delay before a retry. The delay grows exponentially with each attempt up to
+// papiRetryMaxDelay and a random delay up to that value is used so that concurrent requests do not retry together
+func papiRetryDelay(attempt int) time.Duration {
+	maxDelay := papiRetryMaxDelay
+	if attempt < 16 && papiRetryBaseDelay<<uint(attempt) < papiRetryMaxDelay {
+		maxDelay = papiRetryBaseDelay << uint(attempt)
+	}
+	return time.Duration(papiRetryBaseDelay/2+rand.Intn(maxDelay-papiRetryBaseDelay/2+1)) * time.Millisecond
+}
+
+// sleepContext waits for a duration or until ctx is done, whichever comes first
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// papiClientError logs an error returned by a PAPI call with all of its details and returns an error for the Vault
+// client with a status code and a message that does not expose the response of the cluster
+func (b *backend) papiClientError(err error, action string) error {
+	if coded, ok := err.(logical.HTTPCodedError); ok {
+		// Errors created by the plugin already have a status code and a message for the client
+		return logical.CodedError(coded.Code(), fmt.Sprintf("%s: %s", action, coded.Error()))
+	}
+	b.Logger().Error(fmt.Sprintf("%s: %s", action, err))
+	code, message := papiErrorStatus(err)
+	return logical.CodedError(code, fmt.Sprintf("%s: %s", action, message))
+}
+
+// papiErrorStatus returns the Vault status code for an error returned by a PAPI call along with a short description
+// that does not expose the response of the cluster
+func papiErrorStatus(err error) (int, string) {
+	pErr := parsePapiError(err)
+	switch {
+	case pErr == nil && IsPapiConnError(err):
+		return http.StatusServiceUnavailable, "the OneFS cluster could not be reached"
+	case pErr == nil && IsPapiSendError(err):
+		return http.StatusServiceUnavailable, "the OneFS cluster did not respond"
+	case pErr == nil:
+		return http.StatusInternalServerError, "see the Vault server log for details"
+	case pErr.Code == "AEC_NOT_FOUND" || pErr.Status == http.StatusNotFound:
+		return http.StatusNotFound, "the object was not found on the OneFS cluster"
+	case pErr.Code == "AEC_FORBIDDEN" || pErr.Code == "AEC_UNAUTHORIZED" || pErr.Status == http.StatusUnauthorized || pErr.Status == http.StatusForbidden:
+		return http.StatusForbidden, "permission denied by the OneFS cluster"
+	case pErr.Status == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests, "the OneFS cluster is busy, retry later"
+	case pErr.Status >= 500:
+		return http.StatusBadGateway, "the OneFS cluster returned an error"
+	default:
+		return http.StatusBadRequest, "the request was rejected by the OneFS cluster"
+	}
+}
@@ -0,0 +1,119 @@
+package vaultonefs
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testNotFoundBody string = `
+{
+"errors" :
+[
+{
+"code" : "AEC_NOT_FOUND",
+"message" : "Failed to find user for 'BadUser'"
+}
+]
+}`
+
+func TestParsePapiError(t *testing.T) {
+	HelperParsePapiError(t, &papiResponseError{Status: 404, Body: testNotFoundBody}, &papiError{Status: 404, Code: "AEC_NOT_FOUND", Message: "Failed to find user for 'BadUser'"})
+	HelperParsePapiError(t, &papiResponseError{Status: 503}, &papiError{Status: 503})
+	HelperParsePapiError(t, fmt.Errorf("Unable to get token: %w", &papiResponseError{Status: 404, Body: testNotFoundBody}), &papiError{Status: 404, Code: "AEC_NOT_FOUND", Message: "Failed to find user for 'BadUser'"})
+	HelperParsePapiError(t, &papiSendError{Method: "GET", Path: papiLatestPath, Err: syscall.ECONNRESET}, nil)
+	HelperParsePapiError(t, nil, nil)
+}
+
+func TestIsPapiTransientError(t *testing.T) {
+	HelperIsPapiTransientError(t, &papiSendError{Method: "GET", Path: papiLatestPath, Err: syscall.ECONNRESET}, true)
+	HelperIsPapiTransientError(t, &papiResponseError{Status: 503}, true)
+	HelperIsPapiTransientError(t, &papiResponseError{Status: 429}, true)
+	HelperIsPapiTransientError(t, &papiResponseError{Status: 404, Body: testNotFoundBody}, false)
+	HelperIsPapiTransientError(t, &papiSendError{Method: "GET", Path: papiLatestPath, Err: context.Canceled}, false)
+	HelperIsPapiTransientError(t, nil, false)
+}
+
+func TestPapiClientError(t *testing.T) {
+	HelperPapiClientError(t, &papiResponseError{Status: 404, Body: testNotFoundBody}, http.StatusNotFound)
+	HelperPapiClientError(t, &papiResponseError{Status: 403, Body: `{"errors":[{"code":"AEC_FORBIDDEN","message":"Privilege check failed"}]}`}, http.StatusForbidden)
+	HelperPapiClientError(t, &papiResponseError{Status: 400, Body: `{"errors":[{"code":"AEC_BAD_REQUEST","message":"Field: name has invalid value"}]}`}, http.StatusBadRequest)
+	HelperPapiClientError(t, &papiResponseError{Status: 429}, http.StatusTooManyRequests)
+	HelperPapiClientError(t, &papiResponseError{Status: 500}, http.StatusBadGateway)
+	HelperPapiClientError(t, &papiSendError{Method: "GET", Path: papiLatestPath, Err: syscall.ECONNREFUSED}, http.StatusServiceUnavailable)
+	HelperPapiClientError(t, fmt.Errorf("Unexpected failure"), http.StatusInternalServerError)
+	HelperPapiClientError(t, logical.CodedError(http.StatusTooManyRequests, papiLimiterBusyMessage), http.StatusTooManyRequests)
+}
+
+func TestPapiRetryDelay(t *testing.T) {
+	for attempt := 0; attempt < 20; attempt++ {
+		delay := papiRetryDelay(attempt)
+		if delay < time.Duration(papiRetryBaseDelay/2)*time.Millisecond || delay > time.Duration(papiRetryMaxDelay)*time.Millisecond {
+			t.Errorf("Attempt: %d, Delay out of range: %s", attempt, delay)
+		}
+	}
+}
+
+func TestPapiDoRetriesTransientErrors(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret", MaxRetries: 2}
+	if err := b.connect(context.Background(), &b.papiSession, cfg); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	getLatest := func(conn *papi.OnefsConn) error {
+		_, err := papiGetPlatformLatest(conn)
+		return err
+	}
+	f.setUnavailable(2)
+	if err := b.papiDo(context.Background(), cfg, papiCallIdempotent, getLatest); err != nil {
+		t.Errorf("Expected success after retries, Got: %s", err)
+	}
+	f.setUnavailable(3)
+	if err := b.papiDo(context.Background(), cfg, papiCallIdempotent, getLatest); !IsPapiTransientError(err) {
+		t.Errorf("Expected a transient error once the retries are used up, Got: %v", err)
+	}
+	// A call that changes the cluster is not sent again once the request reached the cluster
+	f.setUnavailable(1)
+	if err := b.papiDo(context.Background(), cfg, papiCallChange, getLatest); !IsPapiTransientError(err) {
+		t.Errorf("Expected the 503 of the first attempt, Got: %v", err)
+	}
+	if err := b.papiDo(context.Background(), cfg, papiCallChange, getLatest); err != nil {
+		t.Errorf("Expected success once the endpoint is available, Got: %s", err)
+	}
+}
+
+func HelperParsePapiError(t *testing.T, err error, expected *papiError) {
+	x := parsePapiError(err)
+	if (x == nil) != (expected == nil) || (x != nil && *x != *expected) {
+		t.Errorf("Error: %v, Expected: %+v, Got: %+v", err, expected, x)
+	}
+}
+
+func HelperIsPapiTransientError(t *testing.T, err error, expected bool) {
+	if x := IsPapiTransientError(err); x != expected {
+		t.Errorf("Error: %v, Expected: %t, Got: %t", err, expected, x)
+	}
+}
+
+func HelperPapiClientError(t *testing.T, err error, expected int) {
+	b := newTestBackend()
+	x := b.papiClientError(err, "Unable to do something")
+	coded, ok := x.(logical.HTTPCodedError)
+	if !ok {
+		t.Fatalf("Expected a coded error, Got: %v", x)
+	}
+	if coded.Code() != expected {
+		t.Errorf("Error: %v, Expected code: %d, Got: %d", err, expected, coded.Code())
+	}
+	if strings.Contains(coded.Error(), "AEC_") || strings.Contains(coded.Error(), "Non 2xx") {
+		t.Errorf("Expected a message without cluster details, Got: %s", coded.Error())
+	}
+}
@@ -0,0 +1,118 @@
+package vaultonefs
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPapiQueueTimeout int    = 30
+	papiLimiterBusyMessage  string = "Too many concurrent requests to the OneFS cluster, retry later"
+)
+
+// papiSlotKey marks a context that already holds a slot of the limiter
+type papiSlotKey struct{}
+
+// papiLimiter caps the number of concurrent PAPI operations across every session. When every slot is in use, up to
+// maxQueued operations wait for a slot for at most timeout. Any other operation is rejected
+type papiLimiter struct {
+	maxConcurrent int
+	maxQueued     int
+	timeout       time.Duration
+	slots         chan struct{}
+	lock          sync.Mutex
+	queued        int
+}
+
+func newPapiLimiter(maxConcurrent int, maxQueued int, timeout time.Duration) *papiLimiter {
+	return &papiLimiter{
+		maxConcurrent: maxConcurrent,
+		maxQueued:     maxQueued,
+		timeout:       timeout,
+		slots:         make(chan struct{}, maxConcurrent),
+	}
+}
+
+// acquire takes a slot, waiting in the queue when every slot is in use. A 429 error is returned when the queue is
+// full or no slot became free before the timeout. The returned function releases the slot
+func (l *papiLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	l.lock.Lock()
+	if l.queued >= l.maxQueued {
+		l.lock.Unlock()
+		return nil, logical.CodedError(http.StatusTooManyRequests, papiLimiterBusyMessage)
+	}
+	l.queued++
+	l.lock.Unlock()
+	defer func() {
+		l.lock.Lock()
+		l.queued--
+		l.lock.Unlock()
+	}()
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, logical.CodedError(http.StatusTooManyRequests, papiLimiterBusyMessage)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// usage returns the number of operations in progress and the number of operations waiting for a slot
+func (l *papiLimiter) usage() (int, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.slots), l.queued
+}
+
+// papiLimiterFor returns the limiter for the concurrency settings in a configuration. A new limiter replaces the
+// current one when the settings change. Operations holding a slot of the old limiter release it normally. Nil is
+// returned when the number of concurrent operations is not limited
+func (b *backend) papiLimiterFor(cfg *backendCfg) *papiLimiter {
+	b.limiterLock.Lock()
+	defer b.limiterLock.Unlock()
+	if cfg.MaxConcurrentRequests <= 0 {
+		b.limiter = nil
+		return nil
+	}
+	timeout := time.Duration(valueOrDefault(cfg.QueueTimeout, defaultPapiQueueTimeout)) * time.Second
+	l := b.limiter
+	if l == nil || l.maxConcurrent != cfg.MaxConcurrentRequests || l.maxQueued != cfg.MaxQueuedRequests || l.timeout != timeout {
+		l = newPapiLimiter(cfg.MaxConcurrentRequests, cfg.MaxQueuedRequests, timeout)
+		b.limiter = l
+	}
+	return l
+}
+
+// acquirePapiSlot takes a slot of the limiter for an operation that makes one or more PAPI calls. The returned
+// context is marked so that the PAPI calls made with it do not take another slot. The returned function releases
+// the slot and must always be called
+func (b *backend) acquirePapiSlot(ctx context.Context, cfg *backendCfg) (context.Context, func(), error) {
+	if ctx.Value(papiSlotKey{}) != nil {
+		return ctx, func() {}, nil
+	}
+	l := b.papiLimiterFor(cfg)
+	if l == nil {
+		return ctx, func() {}, nil
+	}
+	release, err := l.acquire(ctx)
+	if err != nil {
+		if coded, ok := err.(logical.HTTPCodedError); ok && coded.Code() == http.StatusTooManyRequests {
+			b.Logger().Warn(fmt.Sprintf("PAPI operation rejected, %d operation(s) in progress", cfg.MaxConcurrentRequests))
+		}
+		return ctx, nil, err
+	}
+	return context.WithValue(ctx, papiSlotKey{}, true), release, nil
+}
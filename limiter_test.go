@@ -0,0 +1,100 @@
+package vaultonefs
+
+import (
+	"context"
+	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPapiLimiter(t *testing.T) {
+	ctx := context.Background()
+	// Without a queue an operation fails as soon as every slot is in use
+	l := newPapiLimiter(1, 0, time.Second)
+	release := HelperPapiLimiterAcquire(t, l, ctx, 0)
+	HelperPapiLimiterAcquire(t, l, ctx, http.StatusTooManyRequests)
+	release()
+	HelperPapiLimiterAcquire(t, l, ctx, 0)()
+
+	// A queued operation gets the slot when it is released
+	l = newPapiLimiter(1, 1, time.Second)
+	release = HelperPapiLimiterAcquire(t, l, ctx, 0)
+	done := make(chan func())
+	go func() {
+		r, _ := l.acquire(ctx)
+		done <- r
+	}()
+	for _, queued := l.usage(); queued != 1; _, queued = l.usage() {
+		time.Sleep(time.Millisecond)
+	}
+	// The queue is full
+	HelperPapiLimiterAcquire(t, l, ctx, http.StatusTooManyRequests)
+	release()
+	if r := <-done; r == nil {
+		t.Errorf("Expected the queued operation to get the slot")
+	} else {
+		r()
+	}
+
+	// A queued operation fails when no slot is released before the timeout
+	l = newPapiLimiter(1, 1, 10*time.Millisecond)
+	release = HelperPapiLimiterAcquire(t, l, ctx, 0)
+	HelperPapiLimiterAcquire(t, l, ctx, http.StatusTooManyRequests)
+	release()
+	if inFlight, queued := l.usage(); inFlight != 0 || queued != 0 {
+		t.Errorf("Expected no operations in progress or queued, Got: %d in progress, %d queued", inFlight, queued)
+	}
+}
+
+func TestPapiDoLimitsConcurrentCalls(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret", MaxConcurrentRequests: 1}
+	getLatest := func(conn *papi.OnefsConn) error {
+		_, err := papiGetPlatformLatest(conn)
+		return err
+	}
+	ctx, release, err := b.acquirePapiSlot(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Unable to acquire a slot: %s", err)
+	}
+	// Calls made with the context holding the slot do not need another one
+	if err := b.papiDo(ctx, cfg, papiCallIdempotent, getLatest); err != nil {
+		t.Errorf("Expected success with the slot held by the context, Got: %s", err)
+	}
+	err = b.papiDo(context.Background(), cfg, papiCallIdempotent, getLatest)
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 error while the slot is in use, Got: %v", err)
+	}
+	release()
+	if err := b.papiDo(context.Background(), cfg, papiCallIdempotent, getLatest); err != nil {
+		t.Errorf("Expected success once the slot is released, Got: %s", err)
+	}
+	// Changing the settings replaces the limiter and removing the limit removes it
+	cfg.MaxConcurrentRequests = 2
+	if l := b.papiLimiterFor(cfg); l == nil || l.maxConcurrent != 2 {
+		t.Errorf("Expected a limiter with 2 slots, Got: %+v", l)
+	}
+	cfg.MaxConcurrentRequests = 0
+	if l := b.papiLimiterFor(cfg); l != nil {
+		t.Errorf("Expected no limiter, Got: %+v", l)
+	}
+}
+
+func HelperPapiLimiterAcquire(t *testing.T, l *papiLimiter, ctx context.Context, expected int) func() {
+	release, err := l.acquire(ctx)
+	if expected == 0 {
+		if err != nil {
+			t.Fatalf("Expected a slot, Got: %s", err)
+		}
+		return release
+	}
+	coded, ok := err.(logical.HTTPCodedError)
+	if !ok || coded.Code() != expected {
+		t.Errorf("Expected error code: %d, Got: %v", expected, err)
+	}
+	return func() {}
+}
@@ -0,0 +1,208 @@
+package vaultonefs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"time"
+)
+
+const (
+	migrationStateComplete string = "complete"
+	migrationStateFailed   string = "failed"
+	migrationStateNotRun   string = "not_run"
+	migrationStateSkipped  string = "skipped"
+	fieldMigrationError    string = "error"
+	fieldMigrationFinished string = "finished"
+	fieldMigrationMigrated string = "migrated"
+	fieldMigrationState    string = "state"
+)
+
+// schemaEntry is implemented by every versioned entry the plugin keeps in storage
+// Entries written before schema versions were introduced have a version of 0
+type schemaEntry interface {
+	schemaVersion() int
+	// migrate upgrades the entry to storageSchemaVersion one version at a time
+	migrate()
+}
+
+// migrationStatus holds the result of the storage migration run when the plugin is initialized
+type migrationStatus struct {
+	Error    string
+	Finished time.Time
+	Migrated int
+	State    string
+}
+
+func (cfg *backendCfg) schemaVersion() int {
+	return cfg.SchemaVersion
+}
+
+func (cfg *backendCfg) migrate() {
+	if cfg.SchemaVersion < 1 {
+		// Any negative TTL meant an unlimited TTL. Only -1 is used from version 1
+		cfg.TTL = normalizeUnlimitedTTL(cfg.TTL)
+		cfg.TTLMax = normalizeUnlimitedTTL(cfg.TTLMax)
+	}
+	if cfg.SchemaVersion < 2 {
+		// Retries of transient errors were added in version 2 and are enabled for existing configurations
+		cfg.MaxRetries = defaultPapiMaxRetries
+	}
+	if cfg.SchemaVersion < storageSchemaVersion {
+		cfg.SchemaVersion = storageSchemaVersion
+	}
+}
+
+func (role *s3Role) schemaVersion() int {
+	return role.SchemaVersion
+}
+
+func (role *s3Role) migrate() {
+	if role.SchemaVersion < 1 {
+		// Roles written before access zones were supported always used the System access zone
+		if role.AccessZone == "" {
+			role.AccessZone = apiPathRolesDynamicDefaultAccessZone
+		}
+		role.TTL = normalizeUnlimitedTTL(role.TTL)
+		role.TTLMax = normalizeUnlimitedTTL(role.TTLMax)
+	}
+	if role.SchemaVersion < storageSchemaVersion {
+		role.SchemaVersion = storageSchemaVersion
+	}
+}
+
+func (role *s3PredefinedRole) schemaVersion() int {
+	return role.SchemaVersion
+}
+
+func (role *s3PredefinedRole) migrate() {
+	if role.SchemaVersion < 1 {
+		if role.AccessZone == "" {
+			role.AccessZone = apiPathRolesPredefinedDefaultAccessZone
+		}
+		role.TTL = normalizeUnlimitedTTL(role.TTL)
+		role.TTLMax = normalizeUnlimitedTTL(role.TTLMax)
+	}
+	if role.SchemaVersion < storageSchemaVersion {
+		role.SchemaVersion = storageSchemaVersion
+	}
+}
+
+func (zone *zoneCfg) schemaVersion() int {
+	return zone.SchemaVersion
+}
+
+func (zone *zoneCfg) migrate() {
+	if zone.SchemaVersion < storageSchemaVersion {
+		zone.SchemaVersion = storageSchemaVersion
+	}
+}
+
+// normalizeUnlimitedTTL returns -1 for any negative TTL
+func normalizeUnlimitedTTL(TTL int) int {
+	if TTL < 0 {
+		return -1
+	}
+	return TTL
+}
+
+// migrateStorage upgrades the stored configuration, access zone configurations and roles to storageSchemaVersion. Entries are also upgraded in
+// memory every time they are read so a node that cannot write to storage still uses the current schema
+func (b *backend) migrateStorage(ctx context.Context, s logical.Storage) *migrationStatus {
+	status := &migrationStatus{State: migrationStateComplete}
+	defer func() {
+		status.Finished = time.Now()
+	}()
+	// Performance standbys and secondaries cannot write to replicated storage. The active node of the primary
+	// cluster migrates the entries and the changes are replicated
+	replState := b.System().ReplicationState()
+	if (!b.System().LocalMount() && replState.HasState(consts.ReplicationPerformanceSecondary)) ||
+		replState.HasState(consts.ReplicationPerformanceStandby|consts.ReplicationDRSecondary) {
+		status.State = migrationStateSkipped
+		return status
+	}
+	keys := []string{apiPathConfigRoot}
+	for _, prefix := range []string{apiPathConfigZones, apiPathRolesDynamic, apiPathRolesPredefined} {
+		names, err := s.List(ctx, prefix)
+		if err != nil {
+			status.State = migrationStateFailed
+			status.Error = err.Error()
+			return status
+		}
+		for _, name := range names {
+			keys = append(keys, prefix+name)
+		}
+	}
+	for _, key := range keys {
+		var entry schemaEntry
+		switch {
+		case key == apiPathConfigRoot:
+			entry = &backendCfg{}
+		case strings.HasPrefix(key, apiPathConfigZones):
+			entry = &zoneCfg{}
+		case strings.HasPrefix(key, apiPathRolesDynamic):
+			entry = &s3Role{}
+		default:
+			entry = &s3PredefinedRole{}
+		}
+		migrated, err := migrateEntry(ctx, s, key, entry)
+		if err != nil {
+			b.Logger().Error(fmt.Sprintf("Unable to migrate storage entry %s: %s", key, err))
+			status.State = migrationStateFailed
+			status.Error = fmt.Sprintf("Unable to migrate storage entry %s: %s", key, err)
+			continue
+		}
+		if migrated {
+			b.clearCache(key)
+			status.Migrated++
+		}
+	}
+	if status.Migrated > 0 {
+		b.Logger().Info(fmt.Sprintf("Migrated %d storage entries to schema version %d", status.Migrated, storageSchemaVersion))
+	}
+	return status
+}
+
+// migrateEntry upgrades a single storage entry in place. The entry is only written when its schema version is older
+// than storageSchemaVersion. An entry written by a newer version of the plugin is left unchanged and returns an error
+func migrateEntry(ctx context.Context, s logical.Storage, key string, entry schemaEntry) (bool, error) {
+	data, err := s.Get(ctx, key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data.Value, entry); err != nil {
+		return false, err
+	}
+	version := entry.schemaVersion()
+	if version > storageSchemaVersion {
+		return false, fmt.Errorf("The entry has schema version %d which is newer than the supported version %d", version, storageSchemaVersion)
+	}
+	if version == storageSchemaVersion {
+		return false, nil
+	}
+	entry.migrate()
+	newEntry, err := logical.StorageEntryJSON(key, entry)
+	if err != nil {
+		return false, err
+	}
+	if err := s.Put(ctx, newEntry); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// responseData returns the migration status for the info endpoint
+func (status *migrationStatus) responseData() map[string]interface{} {
+	if status == nil {
+		return map[string]interface{}{fieldMigrationState: migrationStateNotRun}
+	}
+	return map[string]interface{}{
+		fieldMigrationError:    status.Error,
+		fieldMigrationFinished: formatStatusTime(status.Finished),
+		fieldMigrationMigrated: status.Migrated,
+		fieldMigrationState:    status.State,
+	}
+}
@@ -0,0 +1,65 @@
+package vaultonefs
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hashicorp/vault/sdk/logical"
+	"testing"
+)
+
+func TestMigrateStorage(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	HelperPutRaw(t, s, apiPathConfigRoot, `{"Endpoint":"https://cluster:8080","TTL":-5,"TTLMax":0}`)
+	HelperPutRaw(t, s, apiPathRolesDynamic+"legacy", `{"Bucket":"b1","Groups":["g1"],"TTL":-2}`)
+	HelperPutRaw(t, s, apiPathRolesPredefined+"current", `{"AccessZone":"zone1","TTL":600,"SchemaVersion":2}`)
+	HelperPutRaw(t, s, apiPathConfigZones+"zone1", `{"User":"zone1_mgr","HomeDir":"/ifs/zone1/home"}`)
+	b := newTestBackend()
+	if err := b.Setup(ctx, logical.TestBackendConfig()); err != nil {
+		t.Fatalf("Unable to set up backend: %s", err)
+	}
+	status := b.migrateStorage(ctx, s)
+	if status.State != migrationStateComplete || status.Migrated != 3 {
+		t.Errorf("Expected state: %s with 3 migrated entries, Got: %s with %d, Error: %s", migrationStateComplete, status.State, status.Migrated, status.Error)
+	}
+	cfg := &backendCfg{}
+	HelperGetRaw(t, s, apiPathConfigRoot, cfg)
+	if cfg.SchemaVersion != storageSchemaVersion || cfg.TTL != -1 || cfg.MaxRetries != defaultPapiMaxRetries || cfg.Endpoint != "https://cluster:8080" {
+		t.Errorf("Unexpected migrated config: %+v", cfg)
+	}
+	role := &s3Role{}
+	HelperGetRaw(t, s, apiPathRolesDynamic+"legacy", role)
+	if role.SchemaVersion != storageSchemaVersion || role.TTL != -1 || role.AccessZone != apiPathRolesDynamicDefaultAccessZone {
+		t.Errorf("Unexpected migrated role: %+v", role)
+	}
+	zone := &zoneCfg{}
+	HelperGetRaw(t, s, apiPathConfigZones+"zone1", zone)
+	if zone.SchemaVersion != storageSchemaVersion || zone.User != "zone1_mgr" || zone.HomeDir != "/ifs/zone1/home" {
+		t.Errorf("Unexpected migrated access zone configuration: %+v", zone)
+	}
+	// A second run has nothing left to migrate
+	if status := b.migrateStorage(ctx, s); status.Migrated != 0 {
+		t.Errorf("Expected no migrated entries on the second run, Got: %d", status.Migrated)
+	}
+	// Entries written by a newer version of the plugin are left alone
+	HelperPutRaw(t, s, apiPathRolesPredefined+"newer", `{"AccessZone":"zone1","SchemaVersion":99}`)
+	if status := b.migrateStorage(ctx, s); status.State != migrationStateFailed {
+		t.Errorf("Expected state: %s, Got: %s", migrationStateFailed, status.State)
+	}
+}
+
+func HelperPutRaw(t *testing.T, s logical.Storage, key string, value string) {
+	if err := s.Put(context.Background(), &logical.StorageEntry{Key: key, Value: []byte(value)}); err != nil {
+		t.Fatalf("Unable to store %s: %s", key, err)
+	}
+}
+
+func HelperGetRaw(t *testing.T, s logical.Storage, key string, result interface{}) {
+	data, err := s.Get(context.Background(), key)
+	if err != nil || data == nil {
+		t.Fatalf("Unable to read %s: %v", key, err)
+	}
+	if err := json.Unmarshal(data.Value, result); err != nil {
+		t.Fatalf("Unable to decode %s: %s", key, err)
+	}
+}
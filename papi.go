@@ -0,0 +1,562 @@
+package vaultonefs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPapiConnectTimeout  int    = 30
+	defaultPapiIdleConnTimeout int    = 90
+	defaultPapiMaxIdleConns    int    = 10
+	defaultPapiRequestTimeout  int    = 120
+	papiCookieCsrf             string = "isicsrf"
+	papiCookieSessID           string = "isisessid"
+	papiKeepAliveInterval      int    = 300
+	papiSessionPath            string = "session/1/session"
+)
+
+// ctxTransport attaches a context to every request so that the request is cancelled when the context is done
+type ctxTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *ctxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// papiConnError is a request that failed before a connection to the endpoint was established, while dialing the
+// endpoint or proxy or during the TLS handshake. The request never reached the cluster so it is safe to send again
+type papiConnError struct {
+	Err error
+}
+
+func (e *papiConnError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *papiConnError) Unwrap() error {
+	return e.Err
+}
+
+// papiTransport is the transport of every PAPI connection. Requests that fail before a connection was established
+// are returned as papiConnError so that they can be told apart from requests that failed after they were sent
+type papiTransport struct {
+	base *http.Transport
+}
+
+func (t *papiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var lock sync.Mutex
+	gotConn := false
+	var handshakeErr error
+	// The hooks may run on the goroutine that dials the connection
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			lock.Lock()
+			gotConn = true
+			lock.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			lock.Lock()
+			handshakeErr = err
+			lock.Unlock()
+		},
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil {
+		return resp, nil
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	var opErr *net.OpError
+	dialFailed := errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+	if !gotConn && (dialFailed || handshakeErr != nil) {
+		return nil, &papiConnError{Err: err}
+	}
+	return nil, err
+}
+
+func (t *papiTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+// newPapiTransport creates the HTTP transport for PAPI connections using the TLS, proxy and connection pool settings
+// in the plugin configuration
+func newPapiTransport(cfg *backendCfg) (*papiTransport, error) {
+	tlsCfg, err := buildTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", fieldConfigProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	connectTimeout := time.Duration(valueOrDefault(cfg.ConnectTimeout, defaultPapiConnectTimeout)) * time.Second
+	maxIdleConns := valueOrDefault(cfg.MaxIdleConns, defaultPapiMaxIdleConns)
+	return &papiTransport{base: &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsCfg,
+		TLSHandshakeTimeout: connectTimeout,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+		IdleConnTimeout:     time.Duration(valueOrDefault(cfg.IdleConnTimeout, defaultPapiIdleConnTimeout)) * time.Second,
+	}}, nil
+}
+
+// papiWithContext returns a copy of a connection whose requests are cancelled when ctx is done. The copy shares the
+// session and the pooled connections of the original connection
+func papiWithContext(ctx context.Context, conn *papi.OnefsConn) *papi.OnefsConn {
+	if conn.Papi.Client == nil {
+		return conn
+	}
+	base := conn.Papi.Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	session := *conn.Papi
+	session.Client = &http.Client{
+		Timeout:   conn.Papi.Client.Timeout,
+		Transport: &ctxTransport{ctx: ctx, base: base},
+	}
+	callConn := *conn
+	callConn.Papi = &session
+	return &callConn
+}
+
+// papiConnect creates a PAPI session for a connection using the settings in the plugin configuration
+// go-papi-lite builds its own http.Client inside of Connect which leaves no way to supply a CA bundle or to pin
+// certificates. The session is created here instead and the resulting client and tokens are handed to the library
+func papiConnect(ctx context.Context, conn *papi.OnefsConn, cfg *backendCfg) error {
+	transport, err := newPapiTransport(cfg)
+	if err != nil {
+		return err
+	}
+	if conn.Papi.Client != nil {
+		papiWithContext(ctx, conn).Papi.Disconnect()
+		conn.Papi.Client.CloseIdleConnections()
+	}
+	conn.Papi.SetEndpoint(cfg.Endpoint)
+	conn.Papi.SetUser(cfg.User)
+	conn.Papi.SetPassword(cfg.Password)
+	conn.Papi.SetIgnoreCert(cfg.BypassCert)
+	conn.Papi.SessionToken = ""
+	conn.Papi.CsrfToken = ""
+	conn.Papi.Client = &http.Client{
+		Timeout:   time.Duration(valueOrDefault(cfg.RequestTimeout, defaultPapiRequestTimeout)) * time.Second,
+		Transport: transport,
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"username": cfg.User,
+		"password": cfg.Password,
+		"services": []string{"platform", "namespace"},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", conn.Papi.GetURL(papiSessionPath, nil), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to create session request for endpoint %s: %s", cfg.Endpoint, err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	resp, err := conn.Papi.Client.Do(req)
+	if err != nil {
+		return describeConnError(err, cfg)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unable to create a session on endpoint %s (%d): %s", cfg.Endpoint, resp.StatusCode, string(respBody))
+	}
+	for _, cookie := range resp.Cookies() {
+		switch cookie.Name {
+		case papiCookieSessID:
+			conn.Papi.SessionToken = cookie.Value
+		case papiCookieCsrf:
+			conn.Papi.CsrfToken = cookie.Value
+		}
+	}
+	if conn.Papi.SessionToken == "" || conn.Papi.CsrfToken == "" {
+		return fmt.Errorf("No session or CSRF token returned by endpoint %s", cfg.Endpoint)
+	}
+	apiVer, err := papiGetPlatformLatest(papiWithContext(ctx, conn))
+	if err != nil {
+		return fmt.Errorf("Unable to get latest platform API version from endpoint %s: %w", cfg.Endpoint, err)
+	}
+	conn.PlatformPath = "platform/" + apiVer
+	return nil
+}
+
+// papiSession is a PAPI connection and the endpoint it is connected to. The backend holds the session for the user in
+// config/root and a session for each access zone that is configured with its own user. Calls hold the read lock for
+// their whole duration. Connecting, reconnecting and replacing the connection hold the write lock so they never
+// change the connection while a call is using it
+type papiSession struct {
+	ActiveEndpoint    string
+	Conn              *papi.OnefsConn
+	activeEndpointIdx int
+	// generation is incremented every time the session connects so that concurrent calls that failed on the same
+	// connection only reconnect once
+	generation uint64
+	// closed is set when an access zone session is removed. A closed session is never connected again so calls that
+	// were waiting for it when it was removed cannot bring it back
+	closed bool
+	lock   sync.RWMutex
+}
+
+func newPapiSession() *papiSession {
+	return &papiSession{Conn: papi.NewPapiConn(), activeEndpointIdx: -1}
+}
+
+// endpoint returns the active endpoint and its index in the list of endpoints
+func (sess *papiSession) endpoint() (string, int) {
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	return sess.ActiveEndpoint, sess.activeEndpointIdx
+}
+
+// connected returns true when a session has been created for the connection
+func (sess *papiSession) connected() bool {
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	return sess.Conn != nil && sess.Conn.Papi.Client != nil
+}
+
+// papiCallMode tells papiDoSession which failed calls may be sent again
+type papiCallMode int
+
+const (
+	// papiCallChange is used for calls that change the cluster such as POST and PUT requests. A request that reached
+	// the cluster may have been applied even when no response was received, so these calls are only retried when the
+	// request never reached the cluster
+	papiCallChange papiCallMode = iota
+	// papiCallIdempotent is used for calls that can be repeated safely such as GET and DELETE requests. They are
+	// retried on every transient error
+	papiCallIdempotent
+)
+
+// papiDo runs a function against the connection of the user in config/root. See papiDoSession
+func (b *backend) papiDo(ctx context.Context, cfg *backendCfg, mode papiCallMode, fn func(conn *papi.OnefsConn) error) error {
+	return b.papiDoSession(ctx, &b.papiSession, cfg, mode, fn)
+}
+
+// papiDoZone runs a function against the connection used for an access zone. Access zones configured with their own
+// user use a separate session for that user. All other access zones use the user in config/root
+func (b *backend) papiDoZone(ctx context.Context, s logical.Storage, cfg *backendCfg, zoneName string, mode papiCallMode, fn func(conn *papi.OnefsConn) error) error {
+	zone, err := getZoneCfgFromStorage(ctx, s, zoneName)
+	if err != nil {
+		return err
+	}
+	if zone == nil || zone.User == "" {
+		return b.papiDo(ctx, cfg, mode, fn)
+	}
+	return b.papiDoSession(ctx, b.zoneSession(zoneName), cfg.ZoneConnCfg(zone), mode, fn)
+}
+
+// papiDoSession runs a function against a session, connecting first when necessary. Requests made by the function
+// are cancelled when ctx is done. The call is retried once in two cases. When the session was rejected or has
+// expired, a new session is created with the stored credentials. When no connection to the endpoint could be
+// established and more than one endpoint is configured, the connection fails over to another endpoint. Errors that
+// remain are retried up to MaxRetries times with a jittered exponential backoff. Idempotent calls are retried on any
+// transient error while other calls are only retried when no connection could be established. The call takes a slot
+// of the concurrency limiter unless ctx already holds one
+func (b *backend) papiDoSession(ctx context.Context, sess *papiSession, cfg *backendCfg, mode papiCallMode, fn func(conn *papi.OnefsConn) error) error {
+	ctx, release, err := b.acquirePapiSlot(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	retryable := IsPapiConnError
+	if mode == papiCallIdempotent {
+		retryable = IsPapiTransientError
+	}
+	for attempt := 0; ; attempt++ {
+		err = b.papiDoSessionOnce(ctx, sess, cfg, fn)
+		if attempt >= cfg.MaxRetries || !retryable(err) {
+			break
+		}
+		delay := papiRetryDelay(attempt)
+		b.Logger().Warn(fmt.Sprintf("Transient PAPI error, retrying in %s (%d of %d): %s", delay, attempt+1, cfg.MaxRetries, err))
+		if sleepContext(ctx, delay) != nil {
+			break
+		}
+	}
+	b.recordPapiResult(err)
+	return err
+}
+
+// papiDoSessionOnce makes a single attempt of papiDoSession including the re-authentication and failover retry
+func (b *backend) papiDoSessionOnce(ctx context.Context, sess *papiSession, cfg *backendCfg, fn func(conn *papi.OnefsConn) error) error {
+	gen, endpoint, err := b.sessionCall(ctx, sess, cfg, fn)
+	switch {
+	case IsPapiAuthError(err):
+		b.Logger().Info(fmt.Sprintf("Session for user %s on endpoint %s is no longer valid, re-authenticating", cfg.User, endpoint))
+		if connErr := b.sessionRecover(ctx, sess, cfg, gen, b.reconnect); connErr != nil {
+			err = fmt.Errorf("%s. Re-authentication failed: %w", err, connErr)
+		} else {
+			_, _, err = b.sessionCall(ctx, sess, cfg, fn)
+		}
+	case IsPapiConnError(err) && len(cfg.EndpointList()) > 1:
+		b.Logger().Warn(fmt.Sprintf("Unable to reach endpoint %s, trying another endpoint: %s", endpoint, err))
+		if connErr := b.sessionRecover(ctx, sess, cfg, gen, b.connect); connErr != nil {
+			err = fmt.Errorf("%w. Failover to another endpoint failed: %w", err, connErr)
+		} else {
+			_, _, err = b.sessionCall(ctx, sess, cfg, fn)
+		}
+	}
+	return err
+}
+
+// sessionCall runs a function with the read lock of a session held. The session is connected first when no
+// connection attempt has created an HTTP client yet. The generation and endpoint of the connection that was used are
+// returned along with the result of the function
+func (b *backend) sessionCall(ctx context.Context, sess *papiSession, cfg *backendCfg, fn func(conn *papi.OnefsConn) error) (uint64, string, error) {
+	sess.lock.RLock()
+	if sess.Conn.Papi.Client == nil {
+		sess.lock.RUnlock()
+		sess.lock.Lock()
+		var err error
+		if sess.Conn.Papi.Client == nil {
+			err = b.connect(ctx, sess, cfg)
+		}
+		sess.lock.Unlock()
+		if err != nil {
+			return 0, "", err
+		}
+		sess.lock.RLock()
+	}
+	defer sess.lock.RUnlock()
+	return sess.generation, sess.ActiveEndpoint, fn(papiWithContext(ctx, sess.Conn))
+}
+
+// sessionRecover connects a session again with the write lock held. Nothing is done when the session has connected
+// since the failed call was made as another call has already recovered the session
+func (b *backend) sessionRecover(ctx context.Context, sess *papiSession, cfg *backendCfg, gen uint64, connect func(context.Context, *papiSession, *backendCfg) error) error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if sess.generation != gen {
+		return nil
+	}
+	return connect(ctx, sess, cfg)
+}
+
+// zoneSession returns the session for an access zone, creating an unconnected session when none exists
+func (b *backend) zoneSession(zoneName string) *papiSession {
+	b.zoneSessionsLock.Lock()
+	defer b.zoneSessionsLock.Unlock()
+	if b.zoneSessions == nil {
+		b.zoneSessions = map[string]*papiSession{}
+	}
+	sess, ok := b.zoneSessions[zoneName]
+	if !ok {
+		sess = newPapiSession()
+		b.zoneSessions[zoneName] = sess
+	}
+	return sess
+}
+
+// zoneSessionList returns a copy of the map of access zone sessions
+func (b *backend) zoneSessionList() map[string]*papiSession {
+	b.zoneSessionsLock.Lock()
+	defer b.zoneSessionsLock.Unlock()
+	sessions := make(map[string]*papiSession, len(b.zoneSessions))
+	for zoneName, sess := range b.zoneSessions {
+		sessions[zoneName] = sess
+	}
+	return sessions
+}
+
+// closeZoneSessions disconnects and removes the sessions for the given access zones or for every access zone when no
+// zone is given. The sessions are marked closed so that calls still holding them fail instead of connecting them
+// again. A new session is created on the next call for the access zone
+func (b *backend) closeZoneSessions(zoneNames ...string) {
+	b.zoneSessionsLock.Lock()
+	defer b.zoneSessionsLock.Unlock()
+	if len(zoneNames) == 0 {
+		for zoneName := range b.zoneSessions {
+			zoneNames = append(zoneNames, zoneName)
+		}
+	}
+	for _, zoneName := range zoneNames {
+		if sess, ok := b.zoneSessions[zoneName]; ok {
+			// The write lock waits for calls using the session to finish
+			sess.lock.Lock()
+			sess.closed = true
+			sess.Conn.Disconnect()
+			delete(b.zoneSessions, zoneName)
+			sess.lock.Unlock()
+		}
+	}
+}
+
+// IsPapiAuthError returns true when a PAPI call failed because the session is missing, was rejected or has expired
+func IsPapiAuthError(err error) bool {
+	pErr := parsePapiError(err)
+	return pErr != nil && pErr.Status == http.StatusUnauthorized
+}
+
+// IsPapiConnError returns true when a PAPI call failed because no connection to the endpoint could be established.
+// Only these calls are failed over to another endpoint as the request never reached the cluster
+func IsPapiConnError(err error) bool {
+	var connErr *papiConnError
+	return errors.As(err, &connErr)
+}
+
+// IsPapiSendError returns true when a PAPI call failed without a response from the endpoint. This includes calls that
+// were sent but timed out or lost their connection, which may have been applied by the cluster
+func IsPapiSendError(err error) bool {
+	var sendErr *papiSendError
+	return errors.As(err, &sendErr)
+}
+
+// pluginPeriodKeepAlive makes a lightweight API call when no call has succeeded recently. This keeps the session from
+// expiring due to inactivity and re-authenticates when the session has expired
+func (b *backend) pluginPeriodKeepAlive(ctx context.Context, cfg *backendCfg) {
+	if time.Since(b.getStatus().LastSuccess) < time.Duration(papiKeepAliveInterval)*time.Second {
+		return
+	}
+	err := b.papiDo(ctx, cfg, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+		_, err := papiGetPlatformLatest(conn)
+		return err
+	})
+	if err != nil {
+		b.Logger().Warn(fmt.Sprintf("[pluginPeriodKeepAlive] Session keep alive failed: %s", err))
+	}
+}
+
+// valueOrDefault returns value when it is greater than 0 and def otherwise
+func valueOrDefault(value int, def int) int {
+	if value > 0 {
+		return value
+	}
+	return def
+}
+
+// papiChangePassword changes the password of a user in the System access zone. The connection must have a valid
+// session. The old password is required by OneFS so a user without ISI_PRIV_AUTH can change its own password
+func papiChangePassword(conn *papi.OnefsConn, user string, oldPassword string, newPassword string) error {
+	body, err := json.Marshal(map[string]string{
+		"old_password": oldPassword,
+		"new_password": newPassword,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = papiSend(conn, "PUT", conn.PlatformPath+"/auth/users/"+user+"/change-password", map[string]string{"zone": apiPathRolesDynamicDefaultAccessZone}, body)
+	return err
+}
+
+// papiDeleteS3Keys revokes the S3 keys of a user in an access zone. Both the current key and any old key that has not
+// expired yet are deleted
+func papiDeleteS3Keys(conn *papi.OnefsConn, user string, zone string) error {
+	_, err := papiSend(conn, "DELETE", conn.PlatformPath+"/protocols/s3/keys/"+user, map[string]string{"zone": zone}, nil)
+	return err
+}
+
+// revokeS3Keys deletes a dynamic user and its S3 keys after a request for the user failed. Errors are only logged
+// because the cleanup of expired dynamic users removes anything left behind
+func (b *backend) revokeS3Keys(ctx context.Context, s logical.Storage, cfg *backendCfg, zoneName string, user string) {
+	err := b.papiDoZone(ctx, s, cfg, zoneName, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+		return papiDeleteS3Keys(conn, user, zoneName)
+	})
+	if err != nil {
+		b.Logger().Error(fmt.Sprintf("Unable to revoke the S3 keys of user %s: %s", user, err))
+	}
+	err = b.papiDoZone(ctx, s, cfg, zoneName, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+		return papiDeleteUser(conn, user, zoneName)
+	})
+	if err != nil {
+		b.Logger().Error(fmt.Sprintf("Unable to delete user %s: %s", user, err))
+	}
+}
+
+// discardS3Key revokes the S3 key issued to a predefined user for a request that failed. The user is shared so its
+// keys are not deleted. A new key is generated instead, which discards the old key that was issued and expires the
+// current key immediately. Keys issued to other requests are left alone
+func (b *backend) discardS3Key(ctx context.Context, s logical.Storage, cfg *backendCfg, zoneName string, user string) error {
+	err := b.papiDoZone(ctx, s, cfg, zoneName, papiCallChange, func(conn *papi.OnefsConn) error {
+		_, err := papiGetS3Token(conn, user, zoneName, 0)
+		return err
+	})
+	if err != nil {
+		b.Logger().Error(fmt.Sprintf("Unable to discard the S3 key issued to user %s: %s", user, err))
+	}
+	return err
+}
+
+// papiGetPrivileges returns the RBAC privileges of the user that owns the session. The map key is the privilege ID
+// and the value is true when the privilege is granted with write access
+func papiGetPrivileges(conn *papi.OnefsConn) (map[string]bool, error) {
+	jsonObj, err := papiSend(conn, "GET", conn.PlatformPath+"/auth/id", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Ntoken struct {
+			Privilege []struct {
+				ID         string `json:"id"`
+				Permission string `json:"permission"`
+				ReadOnly   bool   `json:"read_only"`
+			} `json:"privilege"`
+		} `json:"ntoken"`
+	}
+	if err := decodePapiJSON(jsonObj, &result); err != nil {
+		return nil, err
+	}
+	privileges := map[string]bool{}
+	for _, priv := range result.Ntoken.Privilege {
+		// Older releases report a read_only flag while newer releases report a permission of r, w or x
+		writable := !priv.ReadOnly
+		if priv.Permission != "" {
+			writable = priv.Permission != "r"
+		}
+		privileges[priv.ID] = writable
+	}
+	return privileges, nil
+}
+
+// papiGetClusterConfig returns the name, GUID and OneFS version of the cluster
+func papiGetClusterConfig(conn *papi.OnefsConn) (*onefsClusterConfig, error) {
+	jsonObj, err := papiSend(conn, "GET", conn.PlatformPath+"/cluster/config", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := &onefsClusterConfig{}
+	if err := decodePapiJSON(jsonObj, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decodePapiJSON decodes the generic map returned by papiSend into a structure using its JSON tags
+func decodePapiJSON(jsonObj map[string]interface{}, result interface{}) error {
+	raw, err := json.Marshal(jsonObj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
@@ -0,0 +1,231 @@
+package vaultonefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	papi "github.com/murkyl/go-papi-lite"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// papiMaxResume limits the number of pages fetched for a single call that returns a resume token
+	papiMaxResume int = 10000
+	// papiLatestPath returns the latest PAPI version supported by the cluster
+	papiLatestPath string = "platform/latest"
+)
+
+// papiResponseError is a non 2xx response returned by the cluster
+type papiResponseError struct {
+	Status int
+	Body   string
+}
+
+func (e *papiResponseError) Error() string {
+	return fmt.Sprintf("Non 2xx response received (%d): %s", e.Status, e.Body)
+}
+
+// papiSendError is a request that did not receive a complete response from the cluster
+type papiSendError struct {
+	Method string
+	Path   string
+	Err    error
+}
+
+func (e *papiSendError) Error() string {
+	return fmt.Sprintf("Unable to send %s request for %s: %s", e.Method, e.Path, e.Err)
+}
+
+func (e *papiSendError) Unwrap() error {
+	return e.Err
+}
+
+// papiSend makes a PAPI call with the HTTP client and session of a connection and returns the decoded JSON response.
+// Responses with a resume token are fetched until the last page and the lists in every page are combined
+// go-papi-lite has its own Send function. It is not used because on a 401 response it logs in again on its own with
+// a new http.Client that ignores the TLS, proxy and context settings of the plugin. Expired sessions are handled by
+// papiDoSession instead
+func papiSend(conn *papi.OnefsConn, method string, path string, query map[string]string, body []byte) (map[string]interface{}, error) {
+	if conn.Papi.Client == nil {
+		return nil, &papiSendError{Method: method, Path: path, Err: fmt.Errorf("No session has been created")}
+	}
+	result := map[string]interface{}{}
+	for count := 0; count < papiMaxResume; count++ {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, conn.Papi.GetURL(path, query), reqBody)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create %s request for %s: %s", method, path, err)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Cookie", papiCookieSessID+"="+conn.Papi.SessionToken)
+		req.Header.Set("Referer", conn.Papi.Endpoint)
+		req.Header.Set("X-CSRF-Token", conn.Papi.CsrfToken)
+		resp, err := conn.Papi.Client.Do(req)
+		if err != nil {
+			return nil, &papiSendError{Method: method, Path: path, Err: err}
+		}
+		rawBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, &papiSendError{Method: method, Path: path, Err: err}
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, &papiResponseError{Status: resp.StatusCode, Body: string(rawBody)}
+		}
+		// Calls such as DELETE return no body
+		if len(rawBody) == 0 {
+			return result, nil
+		}
+		page := map[string]interface{}{}
+		if err := json.Unmarshal(rawBody, &page); err != nil {
+			return nil, fmt.Errorf("Unable to decode the response to %s request for %s: %s", method, path, err)
+		}
+		resume, _ := page["resume"].(string)
+		delete(page, "resume")
+		delete(page, "total")
+		for key, value := range page {
+			items, isList := value.([]interface{})
+			existing, hasList := result[key].([]interface{})
+			if isList && hasList {
+				result[key] = append(existing, items...)
+			} else {
+				result[key] = value
+			}
+		}
+		if resume == "" {
+			break
+		}
+		// A resume token replaces every other query argument
+		query = map[string]string{"resume": resume}
+	}
+	return result, nil
+}
+
+// papiGetPlatformLatest returns the latest PAPI version supported by the cluster
+func papiGetPlatformLatest(conn *papi.OnefsConn) (string, error) {
+	jsonObj, err := papiSend(conn, "GET", papiLatestPath, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	latest, ok := jsonObj["latest"].(string)
+	if !ok {
+		return "", fmt.Errorf("No latest platform API version returned")
+	}
+	return latest, nil
+}
+
+// papiCreateUser creates an enabled local user with a home directory and primary group in an access zone
+func papiCreateUser(conn *papi.OnefsConn, name string, homedir string, pgroup string, zone string) error {
+	body, err := json.Marshal(papi.OnefsUser{
+		Name:          name,
+		Enabled:       true,
+		HomeDirectory: homedir,
+		PrimaryGroup:  papi.OnefsID{ID: "GROUP:" + pgroup},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = papiSend(conn, "POST", conn.PlatformPath+"/auth/users", map[string]string{"force": "True", "zone": zone}, body)
+	return err
+}
+
+// papiAddUserToGroups adds a user to supplementary groups in an access zone. A user that is already a member of a
+// group is not an error. Every group is tried and the groups that failed are reported together
+func papiAddUserToGroups(conn *papi.OnefsConn, name string, groups []string, zone string) error {
+	body, err := json.Marshal(papi.OnefsID{Name: name, Type: "user"})
+	if err != nil {
+		return err
+	}
+	var failed []string
+	var lastErr error
+	for _, group := range groups {
+		_, err := papiSend(conn, "POST", conn.PlatformPath+"/auth/groups/"+group+"/members", map[string]string{"zone": zone}, body)
+		if pErr := parsePapiError(err); err == nil || (pErr != nil && pErr.Code == "AEC_CONFLICT") {
+			continue
+		}
+		failed = append(failed, group)
+		lastErr = err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to add user %s to group(s) %v: %w", name, failed, lastErr)
+	}
+	return nil
+}
+
+// papiDeleteUser deletes a local user in an access zone
+func papiDeleteUser(conn *papi.OnefsConn, name string, zone string) error {
+	_, err := papiSend(conn, "DELETE", conn.PlatformPath+"/auth/users/"+name, map[string]string{"zone": zone}, nil)
+	return err
+}
+
+// papiGetUserNames returns the names of the local users in an access zone
+func papiGetUserNames(conn *papi.OnefsConn, zone string) ([]string, error) {
+	jsonObj, err := papiSend(conn, "GET", conn.PlatformPath+"/auth/users", map[string]string{"zone": zone}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Users []struct {
+			Name string `json:"name"`
+		} `json:"users"`
+	}
+	if err := decodePapiJSON(jsonObj, &result); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(result.Users))
+	for _, user := range result.Users {
+		names = append(names, user.Name)
+	}
+	return names, nil
+}
+
+// papiGetAccessZoneNames returns the names of every access zone on the cluster
+func papiGetAccessZoneNames(conn *papi.OnefsConn) ([]string, error) {
+	jsonObj, err := papiSend(conn, "GET", conn.PlatformPath+"/zones", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Zones []struct {
+			Name string `json:"name"`
+		} `json:"zones"`
+	}
+	if err := decodePapiJSON(jsonObj, &result); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(result.Zones))
+	for _, zone := range result.Zones {
+		names = append(names, zone.Name)
+	}
+	return names, nil
+}
+
+// papiGetS3Token generates a new S3 key for a user in an access zone. The existing key expires after ttl minutes or
+// immediately when ttl is 0
+func papiGetS3Token(conn *papi.OnefsConn, name string, zone string, ttl int) (*papi.OnefsS3Key, error) {
+	var body []byte
+	if ttl > 0 {
+		var err error
+		body, err = json.Marshal(map[string]int{"existing_key_expiry_time": ttl})
+		if err != nil {
+			return nil, err
+		}
+	}
+	jsonObj, err := papiSend(conn, "POST", conn.PlatformPath+"/protocols/s3/keys/"+name, map[string]string{"force": "true", "zone": zone}, body)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Keys papi.OnefsS3Key `json:"keys"`
+	}
+	if err := decodePapiJSON(jsonObj, &result); err != nil {
+		return nil, err
+	}
+	return &result.Keys, nil
+}
@@ -0,0 +1,407 @@
+package vaultonefs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePapi is a minimal PAPI endpoint that hands out sessions, answers platform/latest and cluster/config and changes
+// the password of the user
+type fakePapi struct {
+	mu       sync.Mutex
+	sessions int
+	valid    map[string]bool
+	server   *httptest.Server
+	// password is the password the cluster accepts when a session is created
+	password string
+	// rejectLogins makes every attempt to create a session fail
+	rejectLogins bool
+	// loginHook is called with the lock held for every attempt to create a session and rejects it when it returns true
+	loginHook func() bool
+	// unavailable is the number of requests that are answered with a 503 before requests succeed again
+	unavailable int
+	// requests has the method and path of every authenticated request
+	requests []string
+}
+
+func newFakePapi() *fakePapi {
+	f := &fakePapi{valid: map[string]bool{}, password: "secret"}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakePapi) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/"+papiSessionPath && r.Method == "POST" {
+		body, _ := ioutil.ReadAll(r.Body)
+		if f.rejectLogins || (f.loginHook != nil && f.loginHook()) || !strings.Contains(string(body), `"password":"`+f.password+`"`) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.sessions++
+		token := fmt.Sprintf("session%d", f.sessions)
+		f.valid[token] = true
+		http.SetCookie(w, &http.Cookie{Name: papiCookieSessID, Value: token})
+		http.SetCookie(w, &http.Cookie{Name: papiCookieCsrf, Value: "csrf"})
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	cookie, err := r.Cookie(papiCookieSessID)
+	if err != nil || !f.valid[cookie.Value] {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"errors":[{"code":"AEC_UNAUTHORIZED","message":"Authorization required"}]}`)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if f.unavailable > 0 {
+		f.unavailable--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"errors":[{"code":"AEC_SYSTEM_INTERNAL_ERROR","message":"Service unavailable"}]}`)
+		return
+	}
+	if r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/change-password") {
+		var change struct {
+			OldPassword string `json:"old_password"`
+			NewPassword string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil || change.OldPassword != f.password {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"AEC_BAD_REQUEST","message":"Invalid old password"}]}`)
+			return
+		}
+		f.password = change.NewPassword
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/cluster/config") {
+		fmt.Fprint(w, `{"guid":"0050569a","name":"cluster1","onefs_version":{"release":"9.5.0.0"}}`)
+		return
+	}
+	fmt.Fprint(w, `{"latest":"12"}`)
+}
+
+// getPassword returns the password the cluster currently accepts
+func (f *fakePapi) getPassword() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.password
+}
+
+// setUnavailable answers the next count requests with a 503
+func (f *fakePapi) setUnavailable(count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unavailable = count
+}
+
+// expireSessions invalidates every session handed out so far
+func (f *fakePapi) expireSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.valid = map[string]bool{}
+}
+
+// setRejectLogins makes every attempt to create a session fail or succeed again
+func (f *fakePapi) setRejectLogins(reject bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejectLogins = reject
+}
+
+func newTestBackend() *backend {
+	b := &backend{papiSession: papiSession{Conn: papi.NewPapiConn(), activeEndpointIdx: -1}}
+	b.Backend = &framework.Backend{}
+	return b
+}
+
+func TestPapiDoReauthenticates(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret"}
+	ctx := context.Background()
+
+	calls := 0
+	getLatest := func(conn *papi.OnefsConn) error {
+		calls++
+		_, err := papiGetPlatformLatest(conn)
+		return err
+	}
+	// The first call connects on demand
+	if err := b.papiDo(ctx, cfg, papiCallIdempotent, getLatest); err != nil {
+		t.Fatalf("Expected success on first call, Got: %s", err)
+	}
+	if f.sessions != 1 || b.ActiveEndpoint != f.server.URL {
+		t.Errorf("Expected 1 session on %s, Got: %d session(s) on %s", f.server.URL, f.sessions, b.ActiveEndpoint)
+	}
+	// An expired session is replaced and the call is retried once
+	f.expireSessions()
+	calls = 0
+	if err := b.papiDo(ctx, cfg, papiCallIdempotent, getLatest); err != nil {
+		t.Fatalf("Expected success after re-authentication, Got: %s", err)
+	}
+	if calls != 2 || f.sessions != 2 {
+		t.Errorf("Expected 2 calls and 2 sessions, Got: %d call(s) and %d session(s)", calls, f.sessions)
+	}
+	// When re-authentication fails the original error is returned along with the reason
+	f.expireSessions()
+	cfg.Password = "wrong"
+	err := b.papiDo(ctx, cfg, papiCallIdempotent, getLatest)
+	if err == nil || !strings.Contains(err.Error(), "Re-authentication failed") {
+		t.Errorf("Expected re-authentication failure, Got: %v", err)
+	}
+}
+
+func TestPapiSendDoesNotReauthenticate(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret"}
+	if err := b.connect(context.Background(), &b.papiSession, cfg); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	// A rejected session is reported to the caller without logging in again behind its back
+	f.expireSessions()
+	_, err := papiGetPlatformLatest(b.Conn)
+	if !IsPapiAuthError(err) {
+		t.Errorf("Expected an authentication error, Got: %v", err)
+	}
+	if f.sessions != 1 {
+		t.Errorf("Expected 1 session, Got: %d", f.sessions)
+	}
+}
+
+func TestPapiDoConcurrentReauthenticates(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret"}
+	if err := b.connect(context.Background(), &b.papiSession, cfg); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	// Calls that fail on the same expired session only create one new session between them
+	f.expireSessions()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- b.papiDo(context.Background(), cfg, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+				_, err := papiGetPlatformLatest(conn)
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected success after re-authentication, Got: %s", err)
+		}
+	}
+	if f.sessions != 2 {
+		t.Errorf("Expected 2 sessions, Got: %d", f.sessions)
+	}
+}
+
+func TestPapiDoHonorsContext(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret"}
+	if err := b.connect(context.Background(), &b.papiSession, cfg); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := b.papiDo(ctx, cfg, papiCallIdempotent, func(conn *papi.OnefsConn) error {
+		_, err := papiGetPlatformLatest(conn)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "context canceled") {
+		t.Errorf("Expected context canceled error, Got: %v", err)
+	}
+}
+
+func TestPapiDoZoneUsesZoneSession(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret"}
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	entry, _ := logical.StorageEntryJSON(apiPathConfigZones+"zone1", &zoneCfg{User: "zone1_mgr", Password: "secret"})
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatalf("Unable to store access zone configuration: %s", err)
+	}
+
+	getLatest := func(conn *papi.OnefsConn) error {
+		_, err := papiGetPlatformLatest(conn)
+		return err
+	}
+	for _, zoneName := range []string{"System", "zone1", "zone1"} {
+		if err := b.papiDoZone(ctx, s, cfg, zoneName, papiCallIdempotent, getLatest); err != nil {
+			t.Fatalf("Expected success for access zone %s, Got: %s", zoneName, err)
+		}
+	}
+	// The access zone without a user shares the root session while zone1 has a session of its own
+	if f.sessions != 2 {
+		t.Errorf("Expected 2 sessions, Got: %d", f.sessions)
+	}
+	sess := b.zoneSession("zone1")
+	if sess.Conn.Papi.User != "zone1_mgr" || sess.ActiveEndpoint != f.server.URL {
+		t.Errorf("Expected zone1 session for zone1_mgr on %s, Got: %s on %s", f.server.URL, sess.Conn.Papi.User, sess.ActiveEndpoint)
+	}
+	b.closeZoneSessions("zone1")
+	if b.zoneSession("zone1") == sess {
+		t.Errorf("Expected a new zone1 session after closing the session")
+	}
+	// A call that still holds the closed session fails instead of connecting it again
+	zone, _ := getZoneCfgFromStorage(ctx, s, "zone1")
+	err := b.papiDoSession(ctx, sess, cfg.ZoneConnCfg(zone), papiCallIdempotent, getLatest)
+	if coded, ok := err.(logical.HTTPCodedError); !ok || coded.Code() != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 error for a closed session, Got: %v", err)
+	}
+	if sess.connected() || f.sessions != 2 {
+		t.Errorf("Expected the closed session to stay disconnected, Got: %d sessions", f.sessions)
+	}
+}
+
+func TestDiscardS3Key(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret"}
+	s := &logical.InmemStorage{}
+	if err := b.discardS3Key(context.Background(), s, cfg, "System", "shared"); err != nil {
+		t.Fatalf("Unable to discard the S3 key: %s", err)
+	}
+	// The keys of the shared user must not be deleted. Only a new key is generated
+	var keyRequests []string
+	for _, r := range f.requests {
+		if strings.Contains(r, "/protocols/s3/keys/") {
+			keyRequests = append(keyRequests, r)
+		}
+	}
+	if len(keyRequests) != 1 || keyRequests[0] != "POST /platform/12/protocols/s3/keys/shared" {
+		t.Errorf("Expected a single POST for a new S3 key, Got: %v", keyRequests)
+	}
+}
+
+func TestRevokeS3Keys(t *testing.T) {
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret"}
+	b.revokeS3Keys(context.Background(), &logical.InmemStorage{}, cfg, "System", "vault_user1")
+	// A dynamic user is deleted along with its keys
+	var deletes []string
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, "DELETE ") {
+			deletes = append(deletes, r)
+		}
+	}
+	if len(deletes) != 2 || !strings.Contains(deletes[0], "/protocols/s3/keys/vault_user1") || !strings.Contains(deletes[1], "/auth/users/vault_user1") {
+		t.Errorf("Expected the keys and the user to be deleted, Got: %v", deletes)
+	}
+}
+
+func TestPapiDoSessionClosedPort(t *testing.T) {
+	ctx := context.Background()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	f := newFakePapi()
+	defer f.server.Close()
+	calls := 0
+	getLatest := func(conn *papi.OnefsConn) error {
+		calls++
+		_, err := papiGetPlatformLatest(conn)
+		return err
+	}
+
+	// A session that cannot connect is reported as an unreachable cluster
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: closed.URL, User: "vault_mgr", Password: "secret", MaxRetries: 1}
+	err := b.papiDoSession(ctx, &b.papiSession, cfg, papiCallChange, getLatest)
+	if status, _ := papiErrorStatus(err); status != http.StatusServiceUnavailable || !IsPapiConnError(err) {
+		t.Errorf("Expected a connection error with status 503, Got: %d %v", status, err)
+	}
+	cfg.Endpoints = []string{closed.URL, closed.URL}
+	err = b.papiDoSession(ctx, &b.papiSession, cfg, papiCallChange, getLatest)
+	if status, _ := papiErrorStatus(err); status != http.StatusServiceUnavailable || !IsPapiConnError(err) {
+		t.Errorf("Expected a connection error with status 503 for every endpoint, Got: %d %v", status, err)
+	}
+
+	// A refused connection fails over to another endpoint
+	cfg.Endpoints = []string{closed.URL, f.server.URL}
+	if err := b.papiDoSession(ctx, &b.papiSession, cfg, papiCallChange, getLatest); err != nil {
+		t.Fatalf("Expected the call to fail over, Got: %s", err)
+	}
+	if b.papiSession.ActiveEndpoint != f.server.URL {
+		t.Errorf("Expected the active endpoint %s, Got: %s", f.server.URL, b.papiSession.ActiveEndpoint)
+	}
+
+	// A call whose connection to the endpoint is refused is retried even when it changes the cluster
+	b = newTestBackend()
+	cfg = &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret", MaxRetries: 1}
+	if err := b.connect(ctx, &b.papiSession, cfg); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	f.server.Close()
+	b.papiSession.Conn.Papi.Client.CloseIdleConnections()
+	calls = 0
+	err = b.papiDoSession(ctx, &b.papiSession, cfg, papiCallChange, getLatest)
+	if status, _ := papiErrorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, Got: %d %v", status, err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the call to be retried once, Got: %d calls", calls)
+	}
+}
+
+func TestPapiTransportConnErrors(t *testing.T) {
+	// Nothing listens on the address of a closed server so the dial fails
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	HelperPapiTransportError(t, closed.URL, true)
+	// The TLS handshake fails as the certificate of the test server is not trusted
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+	HelperPapiTransportError(t, untrusted.URL, true)
+	// The request reached the server which dropped the connection without a response
+	dropped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer dropped.Close()
+	HelperPapiTransportError(t, dropped.URL, false)
+}
+
+func HelperPapiTransportError(t *testing.T, endpoint string, connErr bool) {
+	transport, err := newPapiTransport(&backendCfg{})
+	if err != nil {
+		t.Fatalf("Unable to create transport: %s", err)
+	}
+	conn := papi.NewPapiConn()
+	conn.Papi.SetEndpoint(endpoint)
+	conn.Papi.Client = &http.Client{Transport: transport}
+	_, err = papiGetPlatformLatest(conn)
+	if !IsPapiSendError(err) {
+		t.Errorf("Endpoint: %s, Expected a send error, Got: %v", endpoint, err)
+	}
+	if IsPapiConnError(err) != connErr {
+		t.Errorf("Endpoint: %s, Expected connection error: %t, Got: %v", endpoint, connErr, err)
+	}
+}
@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
 	"net/url"
+	"regexp"
+	"strings"
+	"time"
 )
 
 const (
@@ -17,55 +21,192 @@ const (
 	defaultPathConfigUsernamePrefix string = "vault"
 	defaultPathConfigPrimaryGroup   string = "vault"
 	defaultPathConfigDefaultTTL     int    = 300
+	fieldConfigActiveEndpoint       string = "active_endpoint"
+	fieldConfigAllowedAccessZones   string = "allowed_access_zones"
+	fieldConfigAllowedGroups        string = "allowed_groups"
+	fieldConfigAllowUnlimitedTTL    string = "allow_unlimited_ttl"
 	fieldConfigBypassCert           string = "bypass_cert_check"
+	fieldConfigCACert               string = "ca_cert"
+	fieldConfigCertFingerprints     string = "cert_fingerprints"
 	fieldConfigCleanupPeriod        string = "cleanup_period"
+	fieldConfigConnectTimeout       string = "connect_timeout"
+	fieldConfigDeniedAccessZones    string = "denied_access_zones"
+	fieldConfigDeniedGroups         string = "denied_groups"
 	fieldConfigEndpoint             string = "endpoint"
+	fieldConfigEndpointSelection    string = "endpoint_selection"
+	fieldConfigEndpoints            string = "endpoints"
+	fieldConfigForce                string = "force"
 	fieldConfigHomeDir              string = "homedir"
+	fieldConfigIdleConnTimeout      string = "idle_conn_timeout"
+	fieldConfigMaxConcurrent        string = "max_concurrent_requests"
+	fieldConfigMaxConnsPerHost      string = "max_conns_per_host"
+	fieldConfigMaxIdleConns         string = "max_idle_conns"
+	fieldConfigMaxQueued            string = "max_queued_requests"
+	fieldConfigMaxRetries           string = "max_retries"
 	fieldConfigPassword             string = "password"
+	fieldConfigPasswordPolicy       string = "password_policy"
 	fieldConfigPrimaryGroup         string = "primary_group"
+	fieldConfigProxyURL             string = "proxy_url"
+	fieldConfigQueueTimeout         string = "queue_timeout"
+	fieldConfigRequestTimeout       string = "request_timeout"
+	fieldConfigRotationPeriod       string = "rotation_period"
+	fieldConfigStrictTTL            string = "strict_ttl"
+	fieldConfigTLSServerName        string = "tls_server_name"
 	fieldConfigTTL                  string = "ttl"
 	fieldConfigTTLMax               string = "ttl_max"
 	fieldConfigUser                 string = "user"
 	fieldConfigUsernamePrefix       string = "username_prefix"
+	fieldConfigVerifyConnection     string = "verify_connection"
 	fieldConfigVersion              string = "version"
+	fieldInfoBuildCommit            string = "build_commit"
+	fieldInfoBuildDate              string = "build_date"
+	fieldInfoFeatures               string = "features"
+	fieldInfoGoVersion              string = "go_version"
+	fieldInfoMigration              string = "migration"
+	fieldInfoModes                  string = "modes"
+	fieldInfoStorageVersion         string = "storage_version"
+	invalidOnefsNameChars           string = "\"/\\[]:;|=,+*?<>"
+	// maxOnefsUsernameLen is the longest user name the plugin will create
+	maxOnefsUsernameLen int = 64
+	// dynamicUsernameSuffixLen is the length of everything a dynamic user name adds after the prefix. This is the
+	// length of the random string, request ID, INF marker and timestamp along with their separators
+	dynamicUsernameSuffixLen int = 1 + 6 + 1 + 4 + 1 + 4 + 14
 )
 
+var usernamePrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.-]*$`)
+
 func pathConfigBuild(b *backend) []*framework.Path {
 	return []*framework.Path{
 		{
 			Pattern: apiPathConfigRoot,
 			Fields: map[string]*framework.FieldSchema{
+				fieldConfigAllowedAccessZones: {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "List of access zones that roles may use. Each entry may contain the wildcards * and ?. If not set, every access zone that is not denied may be used.",
+				},
+				fieldConfigAllowedGroups: {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "List of groups that dynamic roles may use. Each entry may contain the wildcards * and ?. If not set, every group that is not denied may be used.",
+				},
+				fieldConfigAllowUnlimitedTTL: {
+					Type:        framework.TypeBool,
+					Description: "Set to false to require ttl_max so that every credential is limited by ttl_max and not only by the max lease TTL of the mount. Roles may then not use -1 for ttl or ttl_max and requests with a TTL of -1 are granted ttl_max. Default is true.",
+				},
 				fieldConfigBypassCert: {
 					Type:        framework.TypeBool,
 					Description: "Set to true to disable SSL certificate authority verification. Default is false.",
 				},
+				fieldConfigCACert: {
+					Type:        framework.TypeString,
+					Description: "PEM encoded CA certificate bundle used to verify the certificate presented by the endpoint. If not set, the system CA certificates will be used.",
+				},
+				fieldConfigCertFingerprints: {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "List of SHA-256 fingerprints in hex format. When set, the certificate presented by the endpoint must match one of the fingerprints. Pinning is enforced even when bypass_cert_check is true.",
+				},
 				fieldConfigCleanupPeriod: {
 					Type:        framework.TypeDurationSecond,
 					Description: fmt.Sprintf("Number of seconds between each automatic user cleanup operation. If not set or 0, default of %d will be used", defaultPathConfigCleanupPeriod),
 				},
+				fieldConfigConnectTimeout: {
+					Type:        framework.TypeDurationSecond,
+					Description: fmt.Sprintf("Number of seconds to wait for a TCP connection and TLS handshake with the endpoint. If not set or 0, default of %d will be used.", defaultPapiConnectTimeout),
+				},
+				fieldConfigDeniedAccessZones: {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "List of access zones that roles may not use. Each entry may contain the wildcards * and ?. A denied access zone takes precedence over allowed_access_zones.",
+				},
+				fieldConfigDeniedGroups: {
+					Type:        framework.TypeCommaStringSlice,
+					Description: fmt.Sprintf("List of groups that dynamic roles may not use. Each entry may contain the wildcards * and ?. A denied group takes precedence over allowed_groups. If not set, '%s' will be used. Set to an empty string to allow every group.", strings.Join(defaultDeniedGroups, ",")),
+				},
 				fieldConfigEndpoint: {
 					Type:        framework.TypeString,
 					Description: "OneFS API endpoint. Typically the endpoint looks like: https://fqdn:8080",
 				},
+				fieldConfigEndpointSelection: {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("Order used to select an endpoint from endpoints when connecting. Valid values are '%s' and '%s'. With '%s' the first healthy endpoint in the list is used and the connection fails back when a higher priority endpoint recovers. With '%s' each new connection starts with the endpoint after the last one used. If not set, '%s' will be used.", endpointSelectionPriority, endpointSelectionRoundRobin, endpointSelectionPriority, endpointSelectionRoundRobin, endpointSelectionPriority),
+				},
+				fieldConfigEndpoints: {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "List of OneFS API endpoints such as individual nodes or SmartConnect names. When set, this list is used instead of endpoint and a failed endpoint is automatically replaced by another endpoint in the list.",
+				},
+				fieldConfigForce: {
+					Type:        framework.TypeBool,
+					Description: "Set to true to delete the configuration even if roles, access zone configurations or dynamic users still exist. Access zone configurations are deleted with it. Only used when deleting the configuration.",
+				},
 				fieldConfigHomeDir: {
 					Type:        framework.TypeString,
 					Description: fmt.Sprintf("Home directory used by all users created by this plugin. The path must start with /ifs. If not set or set to the empty string, default of '%s' will be used.", defaultPathConfigHomeDir),
 				},
+				fieldConfigIdleConnTimeout: {
+					Type:        framework.TypeDurationSecond,
+					Description: fmt.Sprintf("Number of seconds an idle connection to the endpoint is kept open for reuse. If not set or 0, default of %d will be used.", defaultPapiIdleConnTimeout),
+				},
+				fieldConfigMaxConcurrent: {
+					Type:        framework.TypeInt,
+					Description: "Maximum number of PAPI operations run at the same time by this mount. An operation that finds every slot in use waits in the queue or fails with a 429 error. If not set or 0, the number of operations is not limited.",
+				},
+				fieldConfigMaxConnsPerHost: {
+					Type:        framework.TypeInt,
+					Description: "Maximum number of connections to an endpoint, including connections in use. If not set or 0, the number of connections is not limited.",
+				},
+				fieldConfigMaxIdleConns: {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("Maximum number of idle connections kept open for reuse. If not set or 0, default of %d will be used.", defaultPapiMaxIdleConns),
+				},
+				fieldConfigMaxQueued: {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("Maximum number of PAPI operations waiting for a free slot when %s is reached. Operations beyond this fail immediately with a 429 error. If not set or 0, operations are not queued.", fieldConfigMaxConcurrent),
+				},
+				fieldConfigMaxRetries: {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("Number of times a PAPI call is retried. Calls that read or delete are retried on 5xx and 429 responses and requests without a response. Calls that change the cluster are only retried when no connection could be established. Set to 0 to disable retries. Default is %d.", defaultPapiMaxRetries),
+				},
 				fieldConfigPassword: {
 					Type:        framework.TypeString,
 					Description: "Password for user. The password is not returned in a GET of the configuration.",
 				},
+				fieldConfigPasswordPolicy: {
+					Type:        framework.TypeString,
+					Description: "Name of the Vault password policy used to generate new passwords when the root credentials are rotated. If not set, a random alphanumeric password will be generated.",
+				},
 				fieldConfigPrimaryGroup: {
 					Type:        framework.TypeString,
 					Description: fmt.Sprintf("Primary group to be used by all users created by this plugin. The group must already exist in any access zone that will be accessed. If not set or set to the empty string, default of '%s' will be used.", defaultPathConfigPrimaryGroup),
 				},
+				fieldConfigProxyURL: {
+					Type:        framework.TypeString,
+					Description: "URL of the HTTP or HTTPS proxy used to reach the endpoint, e.g. http://proxy.fqdn:3128. If not set, the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables of the Vault server are used.",
+				},
+				fieldConfigQueueTimeout: {
+					Type:        framework.TypeDurationSecond,
+					Description: fmt.Sprintf("Number of seconds a queued PAPI operation waits for a free slot before it fails with a 429 error. If not set or 0, default of %d will be used.", defaultPapiQueueTimeout),
+				},
+				fieldConfigRequestTimeout: {
+					Type:        framework.TypeDurationSecond,
+					Description: fmt.Sprintf("Number of seconds to wait for a single API request to complete, including reading the response. If not set or 0, default of %d will be used.", defaultPapiRequestTimeout),
+				},
+				fieldConfigRotationPeriod: {
+					Type:        framework.TypeDurationSecond,
+					Description: "Number of seconds between automatic rotations of the password for user. If not set or 0, automatic rotation is disabled.",
+				},
+				fieldConfigStrictTTL: {
+					Type:        framework.TypeBool,
+					Description: "Set to true to round TTLs up to the next minute instead of to the nearest minute and to check the expiry of every S3 key returned by OneFS. A key whose expiry does not match the requested TTL is revoked and the request fails. Default is false.",
+				},
+				fieldConfigTLSServerName: {
+					Type:        framework.TypeString,
+					Description: "Server name used to verify the certificate presented by the endpoint. If not set, the host name from the endpoint will be used.",
+				},
 				fieldConfigTTL: {
-					Type:        framework.TypeInt,
-					Description: fmt.Sprintf("Default credential duration for all roles in seconds. If not set or 0, a default of %d seconds will be used. If set to -1 no TTL will be used.", defaultPathConfigDefaultTTL),
+					Type:        framework.TypeSignedDurationSecond,
+					Description: fmt.Sprintf("Default credential duration for all roles as a duration such as 1h or a number of seconds. If not set or 0, a default of %d seconds will be used. If set to -1 the maximum TTL will be used.", defaultPathConfigDefaultTTL),
 				},
 				fieldConfigTTLMax: {
-					Type:        framework.TypeInt,
-					Description: "Default maximum credential duration for all roles in seconds. If not set, 0 or -1, no maximum TTL will be enforced.",
+					Type:        framework.TypeSignedDurationSecond,
+					Description: "Default maximum credential duration for all roles as a duration such as 24h or a number of seconds. If not set, 0 or -1, only the max lease TTL of the mount is enforced.",
 				},
 				fieldConfigUser: {
 					Type:        framework.TypeString,
@@ -75,11 +216,17 @@ func pathConfigBuild(b *backend) []*framework.Path {
 					Type:        framework.TypeString,
 					Description: fmt.Sprintf("Prefix used when creating local users for Vault. If not set or set to the emptry string, default of '%s' will be used.", defaultPathConfigUsernamePrefix),
 				},
+				fieldConfigVerifyConnection: {
+					Type:        framework.TypeBool,
+					Default:     true,
+					Description: "Set to false to skip connecting to the endpoint and checking the RBAC privileges of user before the configuration is saved. Default is true.",
+				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
-				logical.CreateOperation: &framework.PathOperation{Callback: b.pathConfigRootWrite},
+				logical.CreateOperation: &framework.PathOperation{Callback: b.pathConfigRootWrite, ForwardPerformanceStandby: true, ForwardPerformanceSecondary: true},
 				logical.ReadOperation:   &framework.PathOperation{Callback: b.pathConfigRootRead},
-				logical.UpdateOperation: &framework.PathOperation{Callback: b.pathConfigRootWrite},
+				logical.UpdateOperation: &framework.PathOperation{Callback: b.pathConfigRootWrite, ForwardPerformanceStandby: true, ForwardPerformanceSecondary: true},
+				logical.DeleteOperation: &framework.PathOperation{Callback: b.pathConfigRootDelete, ForwardPerformanceStandby: true, ForwardPerformanceSecondary: true},
 			},
 		},
 	}
@@ -99,13 +246,28 @@ func pathConfigInfo(b *backend) []*framework.Path {
 func (b *backend) pathConfigRootInfo(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
 	// Fill a key value struct with the stored values
 	kv := map[string]interface{}{
-		fieldConfigVersion: PluginVersion,
+		fieldConfigVersion:      PluginVersion,
+		fieldInfoBuildCommit:    BuildCommit,
+		fieldInfoBuildDate:      BuildDate,
+		fieldInfoFeatures:       pluginFeatures,
+		fieldInfoGoVersion:      GoVersion(),
+		fieldInfoMigration:      b.Migration.responseData(),
+		fieldInfoModes:          pluginModes,
+		fieldInfoStorageVersion: storageSchemaVersion,
+		fieldStatusConnected:    b.papiSession.connected(),
+	}
+	// The cluster identity is only known once the plugin has connected
+	if cluster := b.getClusterInfo(); kv[fieldStatusConnected] == true && !cluster.Detected.IsZero() {
+		kv[fieldStatusClusterGUID] = cluster.GUID
+		kv[fieldStatusClusterName] = cluster.Name
+		kv[fieldStatusOnefsVersion] = cluster.OnefsVersion
+		kv[fieldStatusPapiVersion] = cluster.PapiVersion
 	}
 	return &logical.Response{Data: kv}, nil
 }
 
 func (b *backend) pathConfigRootRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
-	cfg, err := getCfgFromStorage(ctx, req.Storage)
+	cfg, err := b.getCfg(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
@@ -113,57 +275,176 @@ func (b *backend) pathConfigRootRead(ctx context.Context, req *logical.Request,
 		return nil, nil
 	}
 	// Fill a key value struct with the stored values
+	activeEndpoint, _ := b.papiSession.endpoint()
 	kv := map[string]interface{}{
-		fieldConfigBypassCert:     cfg.BypassCert,
-		fieldConfigCleanupPeriod:  cfg.CleanupPeriod,
-		fieldConfigEndpoint:       cfg.Endpoint,
-		fieldConfigHomeDir:        cfg.HomeDir,
-		fieldConfigPrimaryGroup:   cfg.PrimaryGroup,
-		fieldConfigTTL:            cfg.TTL,
-		fieldConfigTTLMax:         cfg.TTLMax,
-		fieldConfigUser:           cfg.User,
-		fieldConfigUsernamePrefix: cfg.UsernamePrefix,
+		fieldConfigActiveEndpoint:     activeEndpoint,
+		fieldConfigAllowedAccessZones: cfg.AllowedAccessZones,
+		fieldConfigAllowedGroups:      cfg.AllowedGroups,
+		fieldConfigAllowUnlimitedTTL:  !cfg.DenyUnlimitedTTL,
+		fieldConfigBypassCert:         cfg.BypassCert,
+		fieldConfigCACert:             cfg.CACert,
+		fieldConfigCertFingerprints:   cfg.CertFingerprints,
+		fieldConfigCleanupPeriod:      cfg.CleanupPeriod,
+		fieldConfigConnectTimeout:     cfg.ConnectTimeout,
+		fieldConfigDeniedAccessZones:  cfg.DeniedAccessZones,
+		fieldConfigDeniedGroups:       cfg.DeniedGroupList(),
+		fieldConfigEndpoint:           cfg.Endpoint,
+		fieldConfigEndpointSelection:  cfg.EndpointSelection,
+		fieldConfigEndpoints:          cfg.Endpoints,
+		fieldConfigHomeDir:            cfg.HomeDir,
+		fieldConfigIdleConnTimeout:    cfg.IdleConnTimeout,
+		fieldConfigMaxConcurrent:      cfg.MaxConcurrentRequests,
+		fieldConfigMaxConnsPerHost:    cfg.MaxConnsPerHost,
+		fieldConfigMaxIdleConns:       cfg.MaxIdleConns,
+		fieldConfigMaxQueued:          cfg.MaxQueuedRequests,
+		fieldConfigMaxRetries:         cfg.MaxRetries,
+		fieldConfigPasswordPolicy:     cfg.PasswordPolicy,
+		fieldConfigPrimaryGroup:       cfg.PrimaryGroup,
+		fieldConfigProxyURL:           cfg.ProxyURL,
+		fieldConfigQueueTimeout:       cfg.QueueTimeout,
+		fieldConfigRequestTimeout:     cfg.RequestTimeout,
+		fieldConfigRotationPeriod:     cfg.RotationPeriod,
+		fieldConfigStrictTTL:          cfg.StrictTTL,
+		fieldConfigTLSServerName:      cfg.TLSServerName,
+		fieldConfigTTL:                cfg.TTL,
+		fieldConfigTTLMax:             cfg.TTLMax,
+		fieldConfigUser:               cfg.User,
+		fieldConfigUsernamePrefix:     cfg.UsernamePrefix,
 	}
 	return &logical.Response{Data: kv}, nil
 }
 
 func (b *backend) pathConfigRootWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.cfgLock.Lock()
+	defer b.cfgLock.Unlock()
 	// Get existing cfg object or create a new one as necessary
 	cfg, err := getCfgFromStorage(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
+	created := cfg == nil
 	if cfg == nil {
 		cfg = &backendCfg{}
 	}
 	// Set config struct to values from request
+	allowedZones, ok := data.GetOk(fieldConfigAllowedAccessZones)
+	if ok {
+		cfg.AllowedAccessZones = allowedZones.([]string)
+	}
+	allowedGroups, ok := data.GetOk(fieldConfigAllowedGroups)
+	if ok {
+		cfg.AllowedGroups = allowedGroups.([]string)
+	}
+	allowUnlimitedTTL, ok := data.GetOk(fieldConfigAllowUnlimitedTTL)
+	if ok {
+		cfg.DenyUnlimitedTTL = !allowUnlimitedTTL.(bool)
+	}
 	bypassCert, ok := data.GetOk(fieldConfigBypassCert)
 	if ok {
 		cfg.BypassCert = bypassCert.(bool)
 	}
+	caCert, ok := data.GetOk(fieldConfigCACert)
+	if ok {
+		cfg.CACert = caCert.(string)
+	}
+	fingerprints, ok := data.GetOk(fieldConfigCertFingerprints)
+	if ok {
+		cfg.CertFingerprints = fingerprints.([]string)
+	}
 	cleanupPeriod, ok := data.GetOk(fieldConfigCleanupPeriod)
 	if ok {
 		cfg.CleanupPeriod = cleanupPeriod.(int)
 	}
+	connectTimeout, ok := data.GetOk(fieldConfigConnectTimeout)
+	if ok {
+		cfg.ConnectTimeout = connectTimeout.(int)
+	}
+	deniedZones, ok := data.GetOk(fieldConfigDeniedAccessZones)
+	if ok {
+		cfg.DeniedAccessZones = deniedZones.([]string)
+	}
+	deniedGroups, ok := data.GetOk(fieldConfigDeniedGroups)
+	if ok {
+		cfg.DeniedGroups = deniedGroups.([]string)
+	}
 	endpoint, ok := data.GetOk(fieldConfigEndpoint)
 	if ok {
-		_, err := url.Parse(endpoint)
-		if err == nil {
-			cfg.Endpoint = endpoint.(string)
-		}
+		cfg.Endpoint = endpoint.(string)
+	}
+	endpointSelection, ok := data.GetOk(fieldConfigEndpointSelection)
+	if ok {
+		cfg.EndpointSelection = endpointSelection.(string)
+	}
+	endpoints, ok := data.GetOk(fieldConfigEndpoints)
+	if ok {
+		cfg.Endpoints = endpoints.([]string)
 	}
 	homedir, ok := data.GetOk(fieldConfigHomeDir)
 	if ok {
 		cfg.HomeDir = homedir.(string)
 	}
+	idleConnTimeout, ok := data.GetOk(fieldConfigIdleConnTimeout)
+	if ok {
+		cfg.IdleConnTimeout = idleConnTimeout.(int)
+	}
+	maxConcurrent, ok := data.GetOk(fieldConfigMaxConcurrent)
+	if ok {
+		cfg.MaxConcurrentRequests = maxConcurrent.(int)
+	}
+	maxConnsPerHost, ok := data.GetOk(fieldConfigMaxConnsPerHost)
+	if ok {
+		cfg.MaxConnsPerHost = maxConnsPerHost.(int)
+	}
+	maxIdleConns, ok := data.GetOk(fieldConfigMaxIdleConns)
+	if ok {
+		cfg.MaxIdleConns = maxIdleConns.(int)
+	}
+	maxQueued, ok := data.GetOk(fieldConfigMaxQueued)
+	if ok {
+		cfg.MaxQueuedRequests = maxQueued.(int)
+	}
+	maxRetries, ok := data.GetOk(fieldConfigMaxRetries)
+	if ok {
+		cfg.MaxRetries = maxRetries.(int)
+	} else if created {
+		cfg.MaxRetries = defaultPapiMaxRetries
+	}
 	pw, ok := data.GetOk(fieldConfigPassword)
 	if ok {
 		cfg.Password = pw.(string)
 	}
+	pwPolicy, ok := data.GetOk(fieldConfigPasswordPolicy)
+	if ok {
+		cfg.PasswordPolicy = pwPolicy.(string)
+	}
 	pgroup, ok := data.GetOk(fieldConfigPrimaryGroup)
 	if ok {
 		cfg.PrimaryGroup = pgroup.(string)
 	}
+	proxyURL, ok := data.GetOk(fieldConfigProxyURL)
+	if ok {
+		cfg.ProxyURL = proxyURL.(string)
+	}
+	queueTimeout, ok := data.GetOk(fieldConfigQueueTimeout)
+	if ok {
+		cfg.QueueTimeout = queueTimeout.(int)
+	}
+	requestTimeout, ok := data.GetOk(fieldConfigRequestTimeout)
+	if ok {
+		cfg.RequestTimeout = requestTimeout.(int)
+	}
+	rotationPeriod, ok := data.GetOk(fieldConfigRotationPeriod)
+	if ok {
+		cfg.RotationPeriod = rotationPeriod.(int)
+	}
+	strictTTL, ok := data.GetOk(fieldConfigStrictTTL)
+	if ok {
+		cfg.StrictTTL = strictTTL.(bool)
+	}
+	tlsServerName, ok := data.GetOk(fieldConfigTLSServerName)
+	if ok {
+		cfg.TLSServerName = tlsServerName.(string)
+	}
 	ttl, ok := data.GetOk(fieldConfigTTL)
 	if ok {
 		cfg.TTL = ttl.(int)
@@ -180,10 +461,21 @@ func (b *backend) pathConfigRootWrite(ctx context.Context, req *logical.Request,
 	if ok {
 		cfg.UsernamePrefix = usernamePrefix.(string)
 	}
-	// Validate data
+	// Fill in defaults for values that are not set
 	if cfg.CleanupPeriod == 0 {
 		cfg.CleanupPeriod = defaultPathConfigCleanupPeriod
 	}
+	if cfg.DeniedGroups == nil {
+		// An empty list is kept so that the defaults can be removed
+		cfg.DeniedGroups = append([]string(nil), defaultDeniedGroups...)
+	}
+	if cfg.EndpointSelection == "" {
+		cfg.EndpointSelection = endpointSelectionPriority
+	}
+	if _, ok := data.GetOk(fieldConfigPassword); ok || cfg.LastRotation.IsZero() {
+		// A manually supplied password restarts the automatic rotation schedule
+		cfg.LastRotation = time.Now()
+	}
 	if cfg.HomeDir == "" {
 		cfg.HomeDir = defaultPathConfigHomeDir
 	}
@@ -193,15 +485,43 @@ func (b *backend) pathConfigRootWrite(ctx context.Context, req *logical.Request,
 	if cfg.UsernamePrefix == "" {
 		cfg.UsernamePrefix = defaultPathConfigUsernamePrefix
 	}
-	if cfg.TTLMax < 1 {
+	if cfg.TTLMax == 0 {
 		cfg.TTLMax = -1
 	}
-	if cfg.TTL < 0 {
-		cfg.TTL = -1
-	} else if cfg.TTL == 0 {
+	if cfg.TTL == 0 {
 		cfg.TTL = defaultPathConfigDefaultTTL
 	}
+	// Validate data. All problems are collected and returned together and nothing is stored if any are found
+	validationErrors := validateCfg(cfg)
+	if cfg.PasswordPolicy != "" {
+		if _, err := b.System().GeneratePasswordFromPolicy(ctx, cfg.PasswordPolicy); err != nil {
+			validationErrors = append(validationErrors, fmt.Sprintf("%s %s cannot be used: %s", fieldConfigPasswordPolicy, cfg.PasswordPolicy, err))
+		}
+	}
+	if len(validationErrors) > 0 {
+		return logical.ErrorResponse(fmt.Sprintf("Validation errors for config:\n%s", strings.Join(validationErrors, "\n"))), nil
+	}
 
+	res := &logical.Response{}
+	if mountMaxTTL := b.mountMaxTTL(); mountMaxTTL > 0 && (cfg.TTLMax <= 0 || cfg.TTLMax > mountMaxTTL) {
+		res.AddWarning(fmt.Sprintf("Credentials are limited to the max lease TTL of the mount of %d seconds", mountMaxTTL))
+	}
+	if data.Get(fieldConfigVerifyConnection).(bool) {
+		// Dynamic roles in access zones configured with their own user do not need the privileges of this user
+		rootZones, err := b.getRootUserZones(ctx, req.Storage, cfg)
+		if err != nil {
+			return nil, err
+		}
+		warnings, err := b.verifyConnection(ctx, cfg, len(rootZones) > 0)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		for _, warning := range warnings {
+			res.AddWarning(warning)
+		}
+	}
+
+	cfg.SchemaVersion = storageSchemaVersion
 	// Format and store data on the backend server
 	entry, err := logical.StorageEntryJSON((apiPathConfigRoot), cfg)
 	if err != nil {
@@ -213,8 +533,8 @@ func (b *backend) pathConfigRootWrite(ctx context.Context, req *logical.Request,
 	if err = req.Storage.Put(ctx, entry); err != nil {
 		return nil, err
 	}
+	b.clearCache(apiPathConfigRoot)
 
-	res := &logical.Response{}
 	res.AddWarning("Read access to this endpoint should be controlled via ACLs as it will return sensitive information including credentials")
 	err = b.pluginReinit(ctx, req.Storage)
 	if err != nil {
@@ -223,6 +543,220 @@ func (b *backend) pathConfigRootWrite(ctx context.Context, req *logical.Request,
 	return res, nil
 }
 
+// validateCfg checks every value in a configuration and returns a description of each problem found. Certificate
+// fingerprints are normalized in place when they are valid
+func validateCfg(cfg *backendCfg) []string {
+	var validationErrors []string
+	if len(cfg.EndpointList()) == 0 {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s or %s is required", fieldConfigEndpoint, fieldConfigEndpoints))
+	}
+	for _, ep := range cfg.EndpointList() {
+		if err := validateEndpoint(ep); err != nil {
+			validationErrors = append(validationErrors, err.Error())
+		}
+	}
+	switch cfg.EndpointSelection {
+	case endpointSelectionPriority, endpointSelectionRoundRobin:
+	default:
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must be '%s' or '%s', got '%s'", fieldConfigEndpointSelection, endpointSelectionPriority, endpointSelectionRoundRobin, cfg.EndpointSelection))
+	}
+	if cfg.User == "" {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s is required", fieldConfigUser))
+	}
+	if cfg.Password == "" {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s is required", fieldConfigPassword))
+	}
+	validationErrors = append(validationErrors, validateUserDefaults(cfg.HomeDir, cfg.PrimaryGroup, cfg.UsernamePrefix)...)
+	validationErrors = append(validationErrors, validatePatterns(fieldConfigAllowedAccessZones, cfg.AllowedAccessZones)...)
+	validationErrors = append(validationErrors, validatePatterns(fieldConfigDeniedAccessZones, cfg.DeniedAccessZones)...)
+	validationErrors = append(validationErrors, validatePatterns(fieldConfigAllowedGroups, cfg.AllowedGroups)...)
+	validationErrors = append(validationErrors, validatePatterns(fieldConfigDeniedGroups, cfg.DeniedGroups)...)
+	if cfg.CleanupPeriod < 0 {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must not be negative", fieldConfigCleanupPeriod))
+	}
+	if cfg.RotationPeriod < 0 {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must not be negative", fieldConfigRotationPeriod))
+	}
+	httpSettings := []struct {
+		field string
+		value int
+	}{
+		{fieldConfigConnectTimeout, cfg.ConnectTimeout},
+		{fieldConfigIdleConnTimeout, cfg.IdleConnTimeout},
+		{fieldConfigMaxConcurrent, cfg.MaxConcurrentRequests},
+		{fieldConfigMaxConnsPerHost, cfg.MaxConnsPerHost},
+		{fieldConfigMaxIdleConns, cfg.MaxIdleConns},
+		{fieldConfigMaxQueued, cfg.MaxQueuedRequests},
+		{fieldConfigMaxRetries, cfg.MaxRetries},
+		{fieldConfigQueueTimeout, cfg.QueueTimeout},
+		{fieldConfigRequestTimeout, cfg.RequestTimeout},
+	}
+	for _, setting := range httpSettings {
+		if setting.value < 0 {
+			validationErrors = append(validationErrors, fmt.Sprintf("%s must not be negative", setting.field))
+		}
+	}
+	if cfg.ProxyURL != "" {
+		if u, err := url.Parse(cfg.ProxyURL); err != nil || u.Scheme == "" || u.Host == "" {
+			validationErrors = append(validationErrors, fmt.Sprintf("%s must be a URL that includes the protocol and host, e.g. http://proxy.fqdn:3128", fieldConfigProxyURL))
+		}
+	}
+	if cfg.TTL < -1 {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must be -1 or greater", fieldConfigTTL))
+	}
+	if cfg.TTLMax < -1 {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must be -1 or greater", fieldConfigTTLMax))
+	}
+	if cfg.DenyUnlimitedTTL && cfg.TTLMax <= 0 {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must be greater than 0 when %s is false", fieldConfigTTLMax, fieldConfigAllowUnlimitedTTL))
+	}
+	if cfg.DenyUnlimitedTTL && cfg.TTL < 0 {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must not be -1 when %s is false", fieldConfigTTL, fieldConfigAllowUnlimitedTTL))
+	}
+	if cfg.StrictTTL && cfg.TTLMax > 0 && cfg.TTLMax < TTLTimeUnit {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must be at least %d seconds when %s is true", fieldConfigTTLMax, TTLTimeUnit, fieldConfigStrictTTL))
+	}
+	if cfg.TTL > 0 && cfg.TTLMax > 0 && cfg.TTL > cfg.TTLMax {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s (%d) must not be greater than %s (%d)", fieldConfigTTL, cfg.TTL, fieldConfigTTLMax, cfg.TTLMax))
+	}
+	fingerprintsValid := true
+	for i, fp := range cfg.CertFingerprints {
+		normalized, err := NormalizeFingerprint(fp)
+		if err != nil {
+			validationErrors = append(validationErrors, err.Error())
+			fingerprintsValid = false
+			continue
+		}
+		cfg.CertFingerprints[i] = normalized
+	}
+	if fingerprintsValid {
+		if _, err := buildTLSConfig(cfg); err != nil {
+			validationErrors = append(validationErrors, err.Error())
+		}
+	}
+	return validationErrors
+}
+
+// validateUserDefaults checks the values used when creating dynamic users. Empty values are not checked
+func validateUserDefaults(homeDir string, primaryGroup string, usernamePrefix string) []string {
+	var validationErrors []string
+	if homeDir != "" && homeDir != "/ifs" && !strings.HasPrefix(homeDir, "/ifs/") {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must start with /ifs, got '%s'", fieldConfigHomeDir, homeDir))
+	}
+	if strings.ContainsAny(primaryGroup, invalidOnefsNameChars) {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must not contain any of the characters %s", fieldConfigPrimaryGroup, invalidOnefsNameChars))
+	}
+	if usernamePrefix != "" && !usernamePrefixRegexp.MatchString(usernamePrefix) {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must start with a letter or number and only contain letters, numbers, . (period) or - (dash), got '%s'", fieldConfigUsernamePrefix, usernamePrefix))
+	}
+	if len(usernamePrefix)+dynamicUsernameSuffixLen > maxOnefsUsernameLen {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s must be at most %d characters long", fieldConfigUsernamePrefix, maxOnefsUsernameLen-dynamicUsernameSuffixLen))
+	}
+	return validationErrors
+}
+
+// validateEndpoint checks that an endpoint is an absolute http or https URL
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("Invalid endpoint '%s': %s", endpoint, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("Invalid endpoint '%s': the endpoint must include the protocol and host, e.g. https://cluster.fqdn:8080", endpoint)
+	}
+	return nil
+}
+
+// pathConfigRootDelete disconnects from the endpoint and removes the stored configuration. Without the force option
+// the delete is refused while roles exist or dynamically created users have not been cleaned up
+func (b *backend) pathConfigRootDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.cfgLock.Lock()
+	defer b.cfgLock.Unlock()
+	cfg, err := getCfgFromStorage(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, nil
+	}
+	// The access zone configurations hold the passwords of their users and are removed with the configuration
+	zoneNames, err := req.Storage.List(ctx, apiPathConfigZones)
+	if err != nil {
+		return nil, err
+	}
+	if !data.Get(fieldConfigForce).(bool) {
+		var problems []string
+		if len(zoneNames) > 0 {
+			problems = append(problems, fmt.Sprintf("%d access zone configuration(s) exist in %s", len(zoneNames), apiPathConfigZones))
+		}
+		dynamicRoles, err := req.Storage.List(ctx, apiPathRolesDynamic)
+		if err != nil {
+			return nil, err
+		}
+		predefinedRoles, err := req.Storage.List(ctx, apiPathRolesPredefined)
+		if err != nil {
+			return nil, err
+		}
+		if len(dynamicRoles)+len(predefinedRoles) > 0 {
+			problems = append(problems, fmt.Sprintf("%d dynamic and %d predefined role(s) still reference the configuration", len(dynamicRoles), len(predefinedRoles)))
+		}
+		users, err := b.getDynamicUsers(ctx, req.Storage, cfg)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to check for outstanding dynamic users: %s", err))
+		} else if len(users) > 0 {
+			problems = append(problems, fmt.Sprintf("%d dynamic user(s) have not been cleaned up", len(users)))
+		}
+		if len(problems) > 0 {
+			return logical.ErrorResponse(fmt.Sprintf("Unable to delete the configuration. Set %s=true to delete anyway:\n%s", fieldConfigForce, strings.Join(problems, "\n"))), nil
+		}
+	}
+	for _, zoneName := range zoneNames {
+		if err := req.Storage.Delete(ctx, apiPathConfigZones+zoneName); err != nil {
+			return nil, err
+		}
+	}
+	// The sessions are only torn down once the configuration is gone so a failed delete leaves the plugin working
+	if err := req.Storage.Delete(ctx, apiPathConfigRoot); err != nil {
+		return nil, err
+	}
+	b.clearCache(apiPathConfigRoot)
+	b.resetSession(&b.papiSession)
+	b.closeZoneSessions()
+	// Periodic cleanup stops on its own once the configuration is removed from storage
+	b.setNextCleanup(time.Time{})
+	return nil, nil
+}
+
+// verifyConnection connects to the endpoint with a configuration and checks that the user has the RBAC privileges
+// required by the modes in use. Privileges only needed by dynamic mode are reported as a warning when the user is not
+// used by any dynamic role
+func (b *backend) verifyConnection(ctx context.Context, cfg *backendCfg, dynamic bool) ([]string, error) {
+	conn := papi.NewPapiConn()
+	defer conn.Disconnect()
+	if _, err := connectEndpoints(ctx, conn, cfg, EndpointOrderFrom(len(cfg.EndpointList()), 0)); err != nil {
+		return nil, fmt.Errorf("Unable to verify connection: %s", err)
+	}
+	granted, err := papiGetPrivileges(papiWithContext(ctx, conn))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read RBAC privileges for user %s: %s", cfg.User, err)
+	}
+	var warnings []string
+	if err := CheckCapability(capabilityS3, clusterInfo{PapiVersion: ParsePapiVersion(conn.PlatformPath)}); err != nil {
+		warnings = append(warnings, err.Error())
+	}
+	missing := MissingPrivileges(granted, requiredPrivileges)
+	missingDynamic := MissingPrivileges(granted, requiredDynamicPrivileges)
+	if dynamic {
+		missing = append(missing, missingDynamic...)
+	} else if len(missingDynamic) > 0 {
+		warnings = append(warnings, fmt.Sprintf("User %s is missing privileges required for dynamic roles: %s", cfg.User, strings.Join(missingDynamic, ", ")))
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("User %s is missing required RBAC privileges: %s", cfg.User, strings.Join(missing, ", "))
+	}
+	return warnings, nil
+}
+
 func getCfgFromStorage(ctx context.Context, s logical.Storage) (*backendCfg, error) {
 	data, err := s.Get(ctx, apiPathConfigRoot)
 	if err != nil {
@@ -235,5 +769,6 @@ func getCfgFromStorage(ctx context.Context, s logical.Storage) (*backendCfg, err
 	if err := json.Unmarshal(data.Value, cfg); err != nil {
 		return nil, err
 	}
+	cfg.migrate()
 	return cfg, nil
 }
@@ -0,0 +1,165 @@
+package vaultonefs
+
+import (
+	"context"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathConfigRootInfo(t *testing.T) {
+	b := newTestBackend()
+	b.Cluster = clusterInfo{GUID: "0050569f", Name: "cluster1", OnefsVersion: "9.1.0.0", PapiVersion: 11}
+	HelperPathConfigRootInfo(t, b, false)
+	b.Conn.Papi.Client = &http.Client{}
+	HelperPathConfigRootInfo(t, b, false)
+	b.Cluster.Detected = time.Now()
+	HelperPathConfigRootInfo(t, b, true)
+}
+
+func TestValidateCfg(t *testing.T) {
+	HelperValidateCfg(t, func(cfg *backendCfg) {})
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.Endpoint = "" }, "endpoint or endpoints is required")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.Endpoint = "cluster.com:8080" }, "Invalid endpoint")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.Endpoint = "https://cluster.com:8080/%zz" }, "Invalid endpoint")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.Endpoints = []string{"https://a:8080", "b:8080"} }, "Invalid endpoint 'b:8080'")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.EndpointSelection = "random" }, "endpoint_selection")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.HomeDir = "/home/vault" }, "homedir")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.HomeDir = "/ifsvault" }, "homedir")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.HomeDir = "/ifs" })
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.PrimaryGroup = "vault/group" }, "primary_group")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.UsernamePrefix = "vault_prefix" }, "username_prefix")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.UsernamePrefix = "vault.dev-1" })
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.UsernamePrefix = strings.Repeat("v", 40) }, "at most 33 characters")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.TTL = -2 }, "ttl must be -1 or greater")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.TTL = 600; cfg.TTLMax = 300 }, "must not be greater than ttl_max")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.DenyUnlimitedTTL = true }, "ttl_max must be greater than 0")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.DenyUnlimitedTTL = true; cfg.TTLMax = 3600; cfg.TTL = -1 }, "ttl must not be -1")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.DenyUnlimitedTTL = true; cfg.TTLMax = 3600 })
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.StrictTTL = true; cfg.TTL = 30; cfg.TTLMax = 30 }, "ttl_max must be at least 60 seconds")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.CertFingerprints = []string{"abc"} }, "fingerprint")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.CACert = "not a certificate" }, "ca_cert")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.ProxyURL = "proxy.fqdn" }, "proxy_url")
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.ProxyURL = "http://proxy.fqdn:3128"; cfg.RequestTimeout = 30 })
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.ConnectTimeout = -1; cfg.MaxIdleConns = -1 }, "connect_timeout", "max_idle_conns")
+	HelperValidateCfg(t, func(cfg *backendCfg) {
+		cfg.AllowedAccessZones = []string{"tenant*"}
+		cfg.DeniedAccessZones = []string{"System"}
+	})
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.DeniedAccessZones = []string{"tenant[1"} }, "denied_access_zones contains an invalid pattern")
+	// Every problem is reported together
+	HelperValidateCfg(t, func(cfg *backendCfg) { cfg.User = ""; cfg.Password = ""; cfg.CleanupPeriod = -1 }, "user is required", "password is required", "cleanup_period")
+}
+
+func TestPathConfigRootDelete(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret", UsernamePrefix: "vault"}
+	s := &logical.InmemStorage{}
+	entry, _ := logical.StorageEntryJSON(apiPathConfigRoot, cfg)
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatalf("Unable to store config: %s", err)
+	}
+	if err := papiConnect(ctx, b.Conn, cfg); err != nil {
+		t.Fatalf("Unable to connect to the fake cluster: %s", err)
+	}
+	role, _ := logical.StorageEntryJSON(apiPathRolesPredefined+"role1", &s3PredefinedRole{AccessZone: "System"})
+	if err := s.Put(ctx, role); err != nil {
+		t.Fatalf("Unable to store role: %s", err)
+	}
+	// A role still references the configuration so the delete is refused unless forced
+	HelperPathConfigRootDelete(t, b, s, false, false)
+	if b.Conn.Papi.Client == nil {
+		t.Errorf("Expected the connection to stay open after a refused delete")
+	}
+	// An access zone configuration with its own password also refuses the delete
+	if err := s.Delete(ctx, apiPathRolesPredefined+"role1"); err != nil {
+		t.Fatalf("Unable to delete role: %s", err)
+	}
+	zone, _ := logical.StorageEntryJSON(apiPathConfigZones+"zone1", &zoneCfg{User: "zone_mgr", Password: "zonesecret"})
+	if err := s.Put(ctx, zone); err != nil {
+		t.Fatalf("Unable to store access zone config: %s", err)
+	}
+	HelperPathConfigRootDelete(t, b, s, false, false)
+	if stored, _ := getZoneCfgFromStorage(ctx, s, "zone1"); stored == nil {
+		t.Errorf("Expected the access zone configuration to be kept after a refused delete")
+	}
+	HelperPathConfigRootDelete(t, b, s, true, true)
+	if b.Conn.Papi.Client != nil {
+		t.Errorf("Expected the connection to be closed after the delete")
+	}
+	if zones, _ := s.List(ctx, apiPathConfigZones); len(zones) != 0 {
+		t.Errorf("Expected the access zone configurations to be deleted, Got: %v", zones)
+	}
+	// Deleting a configuration that does not exist succeeds
+	HelperPathConfigRootDelete(t, b, s, false, true)
+}
+
+func HelperValidateCfg(t *testing.T, modify func(cfg *backendCfg), expected ...string) {
+	cfg := &backendCfg{
+		CleanupPeriod:     defaultPathConfigCleanupPeriod,
+		Endpoint:          "https://cluster.com:8080",
+		EndpointSelection: endpointSelectionPriority,
+		HomeDir:           defaultPathConfigHomeDir,
+		Password:          "password",
+		PrimaryGroup:      defaultPathConfigPrimaryGroup,
+		TTL:               defaultPathConfigDefaultTTL,
+		TTLMax:            -1,
+		User:              "vault_mgr",
+		UsernamePrefix:    defaultPathConfigUsernamePrefix,
+	}
+	modify(cfg)
+	x := validateCfg(cfg)
+	if len(x) != len(expected) {
+		t.Errorf("Expected %d error(s) containing %v, Got: %v", len(expected), expected, x)
+		return
+	}
+	for i, e := range expected {
+		if !strings.Contains(x[i], e) {
+			t.Errorf("Expected error containing '%s', Got: %s", e, x[i])
+		}
+	}
+}
+
+func HelperPathConfigRootInfo(t *testing.T, b *backend, identity bool) {
+	res, err := b.pathConfigRootInfo(context.Background(), &logical.Request{}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, key := range []string{fieldConfigVersion, fieldInfoBuildCommit, fieldInfoGoVersion, fieldInfoModes, fieldInfoFeatures} {
+		if _, ok := res.Data[key]; !ok {
+			t.Errorf("Expected key %s in the info response", key)
+		}
+	}
+	if res.Data[fieldInfoStorageVersion] != storageSchemaVersion {
+		t.Errorf("Expected storage version %d, Got: %v", storageSchemaVersion, res.Data[fieldInfoStorageVersion])
+	}
+	_, ok := res.Data[fieldStatusClusterGUID]
+	if ok != identity {
+		t.Errorf("Expected cluster identity: %t, Got: %t", identity, ok)
+	}
+}
+
+func HelperPathConfigRootDelete(t *testing.T, b *backend, s logical.Storage, force bool, expectDeleted bool) {
+	ctx := context.Background()
+	data := &framework.FieldData{
+		Raw:    map[string]interface{}{fieldConfigForce: force},
+		Schema: map[string]*framework.FieldSchema{fieldConfigForce: {Type: framework.TypeBool}},
+	}
+	resp, err := b.pathConfigRootDelete(ctx, &logical.Request{Storage: s}, data)
+	if err != nil {
+		t.Fatalf("Force: %t, Unexpected error: %s", force, err)
+	}
+	stored, _ := getCfgFromStorage(ctx, s)
+	if expectDeleted && (stored != nil || (resp != nil && resp.IsError())) {
+		t.Errorf("Force: %t, Expected the configuration to be deleted, Got: %v", force, resp)
+	}
+	if !expectDeleted && (stored == nil || resp == nil || !resp.IsError()) {
+		t.Errorf("Force: %t, Expected the delete to be refused, Got: %v", force, resp)
+	}
+}
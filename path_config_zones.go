@@ -0,0 +1,319 @@
+package vaultonefs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+)
+
+const (
+	pathConfigZonesHelpSynopsis    = "Configure defaults for dynamic users in a single access zone"
+	pathConfigZonesHelpDescription = `
+This endpoint overrides the home directory, primary group and user name prefix from config/root for dynamic users
+created in an access zone. Values that are not set in the access zone fall back to config/root.
+A user and password can be set to manage users and S3 keys in the access zone with an account whose RBAC privileges
+are limited to that access zone. The account has its own session with the cluster.
+`
+)
+
+const (
+	apiPathConfigZones  string = "config/zones/"
+	fieldConfigZoneName string = "zone"
+)
+
+// zoneCfg holds the per access zone overrides of the values in backendCfg. Empty values use the value from backendCfg
+// When User is set, API calls for the access zone are made by that user instead of the user in backendCfg
+type zoneCfg struct {
+	Endpoints    []string
+	HomeDir      string
+	Password     string
+	PrimaryGroup string
+	// SchemaVersion is the version of the storage schema the access zone configuration was written with
+	SchemaVersion  int
+	User           string
+	UsernamePrefix string
+}
+
+func pathConfigZonesBuild(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: apiPathConfigZones + "?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{Callback: b.pathConfigZonesList},
+			},
+			HelpSynopsis:    pathConfigZonesHelpSynopsis,
+			HelpDescription: pathConfigZonesHelpDescription,
+		},
+		{
+			Pattern: apiPathConfigZones + framework.GenericNameRegex(fieldConfigZoneName),
+			Fields: map[string]*framework.FieldSchema{
+				fieldConfigZoneName: {
+					Type:        framework.TypeString,
+					Description: "Name of the access zone on the OneFS cluster.",
+				},
+				fieldConfigEndpoints: {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "List of OneFS API endpoints in the access zone used by user. A user with privileges limited to an access zone has to connect to an IP address in a pool of that access zone. If not set, the endpoints in config/root are used.",
+				},
+				fieldConfigHomeDir: {
+					Type:        framework.TypeString,
+					Description: "Home directory under /ifs for dynamic users in this access zone. If not set, the value in config/root is used.",
+				},
+				fieldConfigPassword: {
+					Type:        framework.TypeString,
+					Description: "Password for user.",
+				},
+				fieldConfigPrimaryGroup: {
+					Type:        framework.TypeString,
+					Description: "Primary group for dynamic users in this access zone. If not set, the value in config/root is used.",
+				},
+				fieldConfigUser: {
+					Type:        framework.TypeString,
+					Description: "User with RBAC privileges in this access zone used to create users and S3 keys in the access zone. If not set, the user in config/root is used.",
+				},
+				fieldConfigUsernamePrefix: {
+					Type:        framework.TypeString,
+					Description: "Prefix for dynamic user names in this access zone. If not set, the value in config/root is used.",
+				},
+				fieldConfigVerifyConnection: {
+					Type:        framework.TypeBool,
+					Default:     true,
+					Description: "Set to false to skip connecting with user and checking its RBAC privileges before the configuration is saved. Default is true.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.CreateOperation: &framework.PathOperation{Callback: b.pathConfigZonesWrite, ForwardPerformanceStandby: true, ForwardPerformanceSecondary: true},
+				logical.ReadOperation:   &framework.PathOperation{Callback: b.pathConfigZonesRead},
+				logical.UpdateOperation: &framework.PathOperation{Callback: b.pathConfigZonesWrite, ForwardPerformanceStandby: true, ForwardPerformanceSecondary: true},
+				logical.DeleteOperation: &framework.PathOperation{Callback: b.pathConfigZonesDelete, ForwardPerformanceStandby: true, ForwardPerformanceSecondary: true},
+			},
+			HelpSynopsis:    pathConfigZonesHelpSynopsis,
+			HelpDescription: pathConfigZonesHelpDescription,
+		},
+	}
+}
+
+func (b *backend) pathConfigZonesList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	zoneList, err := req.Storage.List(ctx, apiPathConfigZones)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(zoneList), nil
+}
+
+func (b *backend) pathConfigZonesRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	zoneName := data.Get(fieldConfigZoneName).(string)
+	if zoneName == "" {
+		return logical.ErrorResponse("Unable to parse access zone name"), nil
+	}
+	zone, err := getZoneCfgFromStorage(ctx, req.Storage, zoneName)
+	if err != nil || zone == nil {
+		return nil, err
+	}
+	// Fill a key value struct with the stored values
+	kv := map[string]interface{}{
+		fieldConfigEndpoints:      zone.Endpoints,
+		fieldConfigHomeDir:        zone.HomeDir,
+		fieldConfigPrimaryGroup:   zone.PrimaryGroup,
+		fieldConfigUser:           zone.User,
+		fieldConfigUsernamePrefix: zone.UsernamePrefix,
+	}
+	return &logical.Response{Data: kv}, nil
+}
+
+func (b *backend) pathConfigZonesWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	zoneName := data.Get(fieldConfigZoneName).(string)
+	if zoneName == "" {
+		return logical.ErrorResponse("Access zone name is missing"), nil
+	}
+	// Get existing zone object or create a new one as necessary
+	zone, err := getZoneCfgFromStorage(ctx, req.Storage, zoneName)
+	if err != nil {
+		return nil, err
+	}
+	if zone == nil {
+		zone = &zoneCfg{}
+	}
+	// Set zone struct to values from request
+	endpoints, ok := data.GetOk(fieldConfigEndpoints)
+	if ok {
+		zone.Endpoints = endpoints.([]string)
+	}
+	homeDir, ok := data.GetOk(fieldConfigHomeDir)
+	if ok {
+		zone.HomeDir = homeDir.(string)
+	}
+	pw, ok := data.GetOk(fieldConfigPassword)
+	if ok {
+		zone.Password = pw.(string)
+	}
+	primaryGroup, ok := data.GetOk(fieldConfigPrimaryGroup)
+	if ok {
+		zone.PrimaryGroup = primaryGroup.(string)
+	}
+	user, ok := data.GetOk(fieldConfigUser)
+	if ok {
+		zone.User = user.(string)
+		if zone.User == "" {
+			// Removing the user removes the credentials of the access zone
+			zone.Password = ""
+		}
+	}
+	usernamePrefix, ok := data.GetOk(fieldConfigUsernamePrefix)
+	if ok {
+		zone.UsernamePrefix = usernamePrefix.(string)
+	}
+	if validationErrors := validateZoneCfg(zone); len(validationErrors) > 0 {
+		return logical.ErrorResponse(fmt.Sprintf("Validation errors for access zone %s:\n%s", zoneName, strings.Join(validationErrors, "\n"))), nil
+	}
+
+	res := &logical.Response{}
+	if zone.User != "" && data.Get(fieldConfigVerifyConnection).(bool) {
+		cfg, err := getCfgFromStorage(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if cfg == nil {
+			return logical.ErrorResponse("Plugin is not configured. Configure the plugin at the URL <plugin_path>/config/root or set verify_connection=false"), nil
+		}
+		dynamicZones, err := b.getActiveAccessZonesFromRoles(ctx, req.Storage, cfg.UsernamePrefix)
+		if err != nil {
+			return nil, err
+		}
+		warnings, err := b.verifyConnection(ctx, cfg.ZoneConnCfg(zone), dynamicZones[zoneName])
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		for _, warning := range warnings {
+			res.AddWarning(warning)
+		}
+	}
+	// Format and store data on the backend server
+	zone.SchemaVersion = storageSchemaVersion
+	entry, err := logical.StorageEntryJSON(apiPathConfigZones+zoneName, zone)
+	if err != nil {
+		return nil, err
+	}
+	if err = req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	// The next call for the access zone connects with the new settings
+	b.closeZoneSessions(zoneName)
+	if len(res.Warnings) > 0 {
+		return res, nil
+	}
+	return nil, nil
+}
+
+// pathConfigZonesDelete removes the overrides for an access zone so that the values in config/root are used again
+func (b *backend) pathConfigZonesDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	zoneName := data.Get(fieldConfigZoneName).(string)
+	if zoneName == "" {
+		return logical.ErrorResponse("Unable to parse access zone name"), nil
+	}
+	if err := req.Storage.Delete(ctx, apiPathConfigZones+zoneName); err != nil {
+		return nil, err
+	}
+	b.closeZoneSessions(zoneName)
+	return nil, nil
+}
+
+// validateZoneCfg checks every value in an access zone configuration and returns a description of each problem found
+func validateZoneCfg(zone *zoneCfg) []string {
+	validationErrors := validateUserDefaults(zone.HomeDir, zone.PrimaryGroup, zone.UsernamePrefix)
+	if zone.User != "" && zone.Password == "" {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s is required when %s is set", fieldConfigPassword, fieldConfigUser))
+	}
+	if zone.User == "" && (zone.Password != "" || len(zone.Endpoints) > 0) {
+		validationErrors = append(validationErrors, fmt.Sprintf("%s and %s are only used with %s", fieldConfigPassword, fieldConfigEndpoints, fieldConfigUser))
+	}
+	for _, ep := range zone.Endpoints {
+		if err := validateEndpoint(ep); err != nil {
+			validationErrors = append(validationErrors, err.Error())
+		}
+	}
+	return validationErrors
+}
+
+// ZoneDefaults returns the dynamic user defaults for an access zone. Values not set in the access zone configuration
+// are taken from the plugin configuration. A nil zone configuration returns the plugin configuration values
+func (cfg *backendCfg) ZoneDefaults(zone *zoneCfg) *zoneCfg {
+	resolved := &zoneCfg{
+		HomeDir:        cfg.HomeDir,
+		PrimaryGroup:   cfg.PrimaryGroup,
+		UsernamePrefix: cfg.UsernamePrefix,
+	}
+	if zone == nil {
+		return resolved
+	}
+	if zone.HomeDir != "" {
+		resolved.HomeDir = zone.HomeDir
+	}
+	if zone.PrimaryGroup != "" {
+		resolved.PrimaryGroup = zone.PrimaryGroup
+	}
+	if zone.UsernamePrefix != "" {
+		resolved.UsernamePrefix = zone.UsernamePrefix
+	}
+	return resolved
+}
+
+// ZoneConnCfg returns the connection settings for an access zone configured with its own user. The TLS, proxy and
+// timeout settings of the plugin configuration are used with the user and endpoints of the access zone
+func (cfg *backendCfg) ZoneConnCfg(zone *zoneCfg) *backendCfg {
+	connCfg := *cfg
+	connCfg.User = zone.User
+	connCfg.Password = zone.Password
+	if len(zone.Endpoints) > 0 {
+		connCfg.Endpoint = ""
+		connCfg.Endpoints = zone.Endpoints
+	}
+	return &connCfg
+}
+
+// getRootUserZones returns the access zones of dynamic roles that are managed by the user in config/root because
+// the access zone is not configured with its own user
+func (b *backend) getRootUserZones(ctx context.Context, s logical.Storage, cfg *backendCfg) (map[string]bool, error) {
+	zones, err := b.getActiveAccessZonesFromRoles(ctx, s, cfg.UsernamePrefix)
+	if err != nil {
+		return nil, err
+	}
+	for zoneName := range zones {
+		zone, err := getZoneCfgFromStorage(ctx, s, zoneName)
+		if err != nil {
+			return nil, err
+		}
+		if zone != nil && zone.User != "" {
+			delete(zones, zoneName)
+		}
+	}
+	return zones, nil
+}
+
+// getZoneDefaults reads the configuration for an access zone and returns the dynamic user defaults for that zone
+func getZoneDefaults(ctx context.Context, s logical.Storage, cfg *backendCfg, zoneName string) (*zoneCfg, error) {
+	zone, err := getZoneCfgFromStorage(ctx, s, zoneName)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.ZoneDefaults(zone), nil
+}
+
+func getZoneCfgFromStorage(ctx context.Context, s logical.Storage, zoneName string) (*zoneCfg, error) {
+	data, err := s.Get(ctx, apiPathConfigZones+zoneName)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	zone := &zoneCfg{}
+	if err := json.Unmarshal(data.Value, zone); err != nil {
+		return nil, err
+	}
+	zone.migrate()
+	return zone, nil
+}
@@ -0,0 +1,43 @@
+package vaultonefs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZoneDefaults(t *testing.T) {
+	cfg := &backendCfg{HomeDir: "/ifs/home/vault", PrimaryGroup: "vault", UsernamePrefix: "vault"}
+	HelperZoneDefaults(t, cfg, nil, &zoneCfg{HomeDir: "/ifs/home/vault", PrimaryGroup: "vault", UsernamePrefix: "vault"})
+	HelperZoneDefaults(t, cfg, &zoneCfg{}, &zoneCfg{HomeDir: "/ifs/home/vault", PrimaryGroup: "vault", UsernamePrefix: "vault"})
+	HelperZoneDefaults(t, cfg, &zoneCfg{PrimaryGroup: "s3users"}, &zoneCfg{HomeDir: "/ifs/home/vault", PrimaryGroup: "s3users", UsernamePrefix: "vault"})
+	HelperZoneDefaults(t, cfg, &zoneCfg{HomeDir: "/ifs/zone1/home", UsernamePrefix: "z1"}, &zoneCfg{HomeDir: "/ifs/zone1/home", PrimaryGroup: "vault", UsernamePrefix: "z1"})
+}
+
+func TestUsernameRegexp(t *testing.T) {
+	rex := usernameRegexp(defaultUserRegexp, []string{"z1.dev", "vault"})
+	HelperUsernameRegexp(t, rex.FindStringSubmatch("z1.dev_4xzkHE_7090_20210826133755"), "20210826133755")
+	HelperUsernameRegexp(t, rex.FindStringSubmatch("vault_4xzkHE_7090_20210826133755"), "20210826133755")
+	HelperUsernameRegexp(t, rex.FindStringSubmatch("z1xdev_4xzkHE_7090_20210826133755"), "")
+	HelperUsernameRegexp(t, rex.FindStringSubmatch("other_4xzkHE_7090_20210826133755"), "")
+	rexInf := usernameRegexp(defaultUserInfRegexp, []string{"vault"})
+	if !rexInf.MatchString("vault_4xzkHE_7090_INF_20210826133755") {
+		t.Errorf("Expected the unlimited duration user name to match")
+	}
+}
+
+func HelperZoneDefaults(t *testing.T, cfg *backendCfg, zone *zoneCfg, expected *zoneCfg) {
+	x := cfg.ZoneDefaults(zone)
+	if !reflect.DeepEqual(x, expected) {
+		t.Errorf("Zone: %+v, Expected: %+v, Got: %+v", zone, expected, x)
+	}
+}
+
+func HelperUsernameRegexp(t *testing.T, result []string, expected string) {
+	x := ""
+	if result != nil {
+		x = result[1]
+	}
+	if x != expected {
+		t.Errorf("Expected timestamp: '%s', Got: '%s'", expected, x)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"net/http"
 	"time"
 )
 
@@ -28,12 +30,12 @@ func pathCredsDynamicBuild(b *backend) []*framework.Path {
 					Description: "Name of the role to get an access token and secret",
 				},
 				fieldPathCredsDynamicTTL: {
-					Type:        framework.TypeInt,
-					Description: "Requested credentials duration in seconds. If not set or set to 0, configured default will be used. If set to -1, an unlimited duration credential will be requested if possible. Otherwise the maximum lease time will be granted.",
+					Type:        framework.TypeSignedDurationSecond,
+					Description: "Requested credentials duration as a duration such as 1h or a number of seconds. If not set or set to 0, configured default will be used. If set to -1, the maximum TTL of the role, plugin configuration and max lease TTL of the mount will be granted.",
 				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
-				logical.ReadOperation: &framework.PathOperation{Callback: b.pathCredsDynamicRead},
+				logical.ReadOperation: &framework.PathOperation{Callback: b.pathCredsDynamicRead, ForwardPerformanceStandby: true},
 			},
 		},
 	}
@@ -45,6 +47,9 @@ func pathCredsDynamicBuild(b *backend) []*framework.Path {
 // secret_key is a text string of the access ID secret
 // key_expiry is the expiration time of the access ID and secret given in UNIX epoch timestamp seconds.
 func (b *backend) pathCredsDynamicRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, true); err != nil {
+		return nil, err
+	}
 	roleName := data.Get(fieldPathCredsDynamicName).(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Unable to parse role name"), nil
@@ -55,22 +60,45 @@ func (b *backend) pathCredsDynamicRead(ctx context.Context, req *logical.Request
 		credTTL = TTLDuration.(int)
 	}
 	// Get configuration from backend storage
-	role, err := getDynamicRoleFromStorage(ctx, req.Storage, roleName)
+	role, err := b.getDynamicRole(ctx, req.Storage, roleName)
 	if err != nil || role == nil {
 		return nil, err
 	}
-	cfg, err := getCfgFromStorage(ctx, req.Storage)
+	cfg, err := b.getCfg(ctx, req.Storage)
 	if err != nil || cfg == nil {
 		return nil, err
 	}
-	// Calculate actual TTL in minutes based on the requested TTL and the rules in the role and plugin config
-	maxTTL := CalcMaxTTL(role.TTLMax, cfg.TTLMax)
-	TTLSeconds := CalcTTL(credTTL, role.TTL, cfg.TTL, maxTTL)
-	TTLMinutes := 0
-	if TTLSeconds > 0 {
-		TTLMinutes = RoundTTLToUnit(TTLSeconds, TTLTimeUnit) / TTLTimeUnit
-	} else {
-		TTLMinutes = TTLSeconds // The TTL should be 0 or -1 which results in an infinite lease
+	// The access zone and group restrictions may have changed since the role was written
+	if err := cfg.CheckAccessZone(role.AccessZone); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to issue credentials for role %s: %s", roleName, err)), nil
+	}
+	if err := cfg.CheckGroups(role.Groups); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to issue credentials for role %s:\n%s", roleName, err)), nil
+	}
+	// The home directory, primary group and user name prefix can be overridden for each access zone
+	zone, err := getZoneDefaults(ctx, req.Storage, cfg, role.AccessZone)
+	if err != nil {
+		return nil, err
+	}
+	// Calculate actual TTL in minutes based on the requested TTL and the rules in the role, plugin config and mount
+	TTLSeconds, maxTTL := CalcMountTTL(credTTL, role.TTL, role.TTLMax, cfg.TTL, cfg.TTLMax, b.mountMaxTTL())
+	TTLMinutes, err := CalcTTLMinutes(TTLSeconds, maxTTL, !cfg.DenyUnlimitedTTL, cfg.StrictTTL)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to issue credentials for role %s: %s", roleName, err)), nil
+	}
+	if err := CheckTTLMin(TTLMinutes*TTLTimeUnit, role.TTLMin); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to issue credentials for role %s: %s", roleName, err)), nil
+	}
+
+	// Older clusters return a generic error for the S3 API so report the missing feature instead
+	cluster := b.getClusterInfo()
+	if err := CheckCapability(capabilityS3, cluster); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if TTLMinutes > 0 {
+		if err := CheckCapability(capabilityS3KeyExpiry, cluster); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 	}
 
 	// Generate username
@@ -88,24 +116,40 @@ func (b *backend) pathCredsDynamicRead(ctx context.Context, req *logical.Request
 		credTime = credTime.Add(time.Duration(TTLMinutes*TTLTimeUnit) * time.Second)
 		credTimeString = defaultPathCredsDynamicExpireSprintf
 	}
-	username := fmt.Sprintf(credTimeString, cfg.UsernamePrefix, randString, req.ID[0:4], credTime.Format(defaultPathCredsDynamicTimeFormat))
+	username := fmt.Sprintf(credTimeString, zone.UsernamePrefix, randString, req.ID[0:4], credTime.Format(defaultPathCredsDynamicTimeFormat))
 
+	// Every PAPI call made to issue the credentials shares one slot of the concurrency limiter so that a request is
+	// not rejected part way through
+	ctx, release, err := b.acquirePapiSlot(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	// Create the user
-	_, err = b.Conn.CreateUser(username, cfg.HomeDir, cfg.PrimaryGroup, role.AccessZone)
+	err = b.papiDoZone(ctx, req.Storage, cfg, role.AccessZone, papiCallChange, func(conn *papi.OnefsConn) error {
+		return papiCreateUser(conn, username, zone.HomeDir, zone.PrimaryGroup, role.AccessZone)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Error creating user: %s", err)
+		return nil, b.papiClientError(err, fmt.Sprintf("Unable to create user %s", username))
 	}
 
 	// Update user with all the appropriate group memberships from the role
-	err = b.Conn.SetUserSuplementalGroups(username, role.Groups, role.AccessZone)
+	err = b.papiDoZone(ctx, req.Storage, cfg, role.AccessZone, papiCallChange, func(conn *papi.OnefsConn) error {
+		return papiAddUserToGroups(conn, username, role.Groups, role.AccessZone)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Error setting user's supplemental groups: %s", err)
+		return nil, b.papiClientError(err, fmt.Sprintf("Unable to set the supplemental groups of user %s", username))
 	}
 
 	// Get the S3 access ID and secret key
-	token, err := b.Conn.GetS3Token(username, role.AccessZone, 0)
+	var token *papi.OnefsS3Key
+	err = b.papiDoZone(ctx, req.Storage, cfg, role.AccessZone, papiCallChange, func(conn *papi.OnefsConn) error {
+		var err error
+		token, err = papiGetS3Token(conn, username, role.AccessZone, 0)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get S3 token for user %s: %s", username, err)
+		return nil, b.papiClientError(err, fmt.Sprintf("Unable to get S3 token for user %s", username))
 	}
 	// Fill a key value struct with the stored values
 	kv := map[string]interface{}{
@@ -115,9 +159,22 @@ func (b *backend) pathCredsDynamicRead(ctx context.Context, req *logical.Request
 	}
 	// To have a token automatically expire, you need to create a second token and set the expiration duration of the previous token
 	if TTLMinutes > 0 {
-		token2, err := b.Conn.GetS3Token(username, role.AccessZone, TTLMinutes)
+		var token2 *papi.OnefsS3Key
+		expected := time.Now().Add(time.Duration(TTLMinutes*TTLTimeUnit) * time.Second)
+		err := b.papiDoZone(ctx, req.Storage, cfg, role.AccessZone, papiCallChange, func(conn *papi.OnefsConn) error {
+			var err error
+			token2, err = papiGetS3Token(conn, username, role.AccessZone, TTLMinutes)
+			return err
+		})
 		if err != nil {
-			return nil, fmt.Errorf("Unable to get the second S3 token for user %s: %s", username, err)
+			return nil, b.papiClientError(err, fmt.Sprintf("Unable to get the second S3 token for user %s", username))
+		}
+		// In strict mode a key that does not expire when requested is revoked instead of being handed out
+		if cfg.StrictTTL {
+			if err := CheckKeyExpiry(token2.OldKeyExpiry, expected); err != nil {
+				b.revokeS3Keys(ctx, req.Storage, cfg, role.AccessZone, username)
+				return nil, logical.CodedError(http.StatusBadGateway, fmt.Sprintf("Unable to issue credentials for user %s: %s. The user and its keys have been deleted. Check that the clocks of Vault and the OneFS cluster are in sync", username, err))
+			}
 		}
 		kv["key_expiry"] = token2.OldKeyExpiry
 	}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"net/http"
+	"time"
 )
 
 const (
@@ -23,12 +26,12 @@ func pathCredsPredefinedBuild(b *backend) []*framework.Path {
 					Description: "Name of the role to get an access token and secret",
 				},
 				fieldPathCredsPredefinedTTL: {
-					Type:        framework.TypeInt,
-					Description: "Requested credentials duration in seconds. If not set or set to 0, configured default will be used. If set to -1, an unlimited duration credential will be requested if possible. Otherwise the maximum lease time will be granted.",
+					Type:        framework.TypeSignedDurationSecond,
+					Description: "Requested credentials duration as a duration such as 1h or a number of seconds. If not set or set to 0, configured default will be used. If set to -1, the maximum TTL of the role, plugin configuration and max lease TTL of the mount will be granted.",
 				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
-				logical.ReadOperation: &framework.PathOperation{Callback: b.pathCredsPredefinedRead},
+				logical.ReadOperation: &framework.PathOperation{Callback: b.pathCredsPredefinedRead, ForwardPerformanceStandby: true},
 			},
 		},
 	}
@@ -40,6 +43,9 @@ func pathCredsPredefinedBuild(b *backend) []*framework.Path {
 // secret_key is a text string of the access ID secret
 // key_expiry is the expiration time of the access ID and secret given in UNIX epoch timestamp seconds.
 func (b *backend) pathCredsPredefinedRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, true); err != nil {
+		return nil, err
+	}
 	roleName := data.Get(fieldPathCredsPredefinedName).(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Unable to parse role name"), nil
@@ -50,28 +56,54 @@ func (b *backend) pathCredsPredefinedRead(ctx context.Context, req *logical.Requ
 		credTTL = TTLDuration.(int)
 	}
 	// Get configuration from backend storage
-	role, err := getPredefinedRoleFromStorage(ctx, req.Storage, roleName)
+	role, err := b.getPredefinedRole(ctx, req.Storage, roleName)
 	if err != nil || role == nil {
 		return nil, err
 	}
-	cfg, err := getCfgFromStorage(ctx, req.Storage)
+	cfg, err := b.getCfg(ctx, req.Storage)
 	if err != nil || cfg == nil {
 		return nil, err
 	}
-	// Calculate actual TTL in minutes based on the requested TTL and the rules in the role and plugin config
-	maxTTL := CalcMaxTTL(role.TTLMax, cfg.TTLMax)
-	TTLSeconds := CalcTTL(credTTL, role.TTL, cfg.TTL, maxTTL)
-	TTLMinutes := 0
-	if TTLSeconds > 0 {
-		TTLMinutes = RoundTTLToUnit(TTLSeconds, TTLTimeUnit) / TTLTimeUnit
-	} else {
-		TTLMinutes = TTLSeconds // The TTL should be 0 or -1 which results in an infinite lease
+	// The access zone restrictions may have changed since the role was written
+	if err := cfg.CheckAccessZone(role.AccessZone); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to issue credentials for role %s: %s", roleName, err)), nil
+	}
+	// Calculate actual TTL in minutes based on the requested TTL and the rules in the role, plugin config and mount
+	TTLSeconds, maxTTL := CalcMountTTL(credTTL, role.TTL, role.TTLMax, cfg.TTL, cfg.TTLMax, b.mountMaxTTL())
+	TTLMinutes, err := CalcTTLMinutes(TTLSeconds, maxTTL, !cfg.DenyUnlimitedTTL, cfg.StrictTTL)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to issue credentials for role %s: %s", roleName, err)), nil
+	}
+	if err := CheckTTLMin(TTLMinutes*TTLTimeUnit, role.TTLMin); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to issue credentials for role %s: %s", roleName, err)), nil
 	}
 
+	// Older clusters return a generic error for the S3 API so report the missing feature instead
+	cluster := b.getClusterInfo()
+	if err := CheckCapability(capabilityS3, cluster); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if TTLMinutes > 0 {
+		if err := CheckCapability(capabilityS3KeyExpiry, cluster); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	// Every PAPI call made to issue the credentials shares one slot of the concurrency limiter so that a request is
+	// not rejected part way through
+	ctx, release, err := b.acquirePapiSlot(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	// Get the S3 access ID and secret key
-	token, err := b.Conn.GetS3Token(roleName, role.AccessZone, 0)
+	var token *papi.OnefsS3Key
+	err = b.papiDoZone(ctx, req.Storage, cfg, role.AccessZone, papiCallChange, func(conn *papi.OnefsConn) error {
+		var err error
+		token, err = papiGetS3Token(conn, roleName, role.AccessZone, 0)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get S3 token for user %s: %s", roleName, err)
+		return nil, b.papiClientError(err, fmt.Sprintf("Unable to get S3 token for user %s", roleName))
 	}
 	// Fill a key value struct with the stored values
 	kv := map[string]interface{}{
@@ -81,9 +113,24 @@ func (b *backend) pathCredsPredefinedRead(ctx context.Context, req *logical.Requ
 	}
 	// To have a token automatically expire, you need to create a second token and set the expiration duration of the previous token
 	if TTLMinutes > 0 {
-		token2, err := b.Conn.GetS3Token(roleName, role.AccessZone, TTLMinutes)
+		var token2 *papi.OnefsS3Key
+		expected := time.Now().Add(time.Duration(TTLMinutes*TTLTimeUnit) * time.Second)
+		err := b.papiDoZone(ctx, req.Storage, cfg, role.AccessZone, papiCallChange, func(conn *papi.OnefsConn) error {
+			var err error
+			token2, err = papiGetS3Token(conn, roleName, role.AccessZone, TTLMinutes)
+			return err
+		})
 		if err != nil {
-			return nil, fmt.Errorf("Unable to get the second S3 token for user %s: %s", roleName, err)
+			return nil, b.papiClientError(err, fmt.Sprintf("Unable to get the second S3 token for user %s", roleName))
+		}
+		// In strict mode a key that does not expire when requested is discarded instead of being handed out
+		if cfg.StrictTTL {
+			if err := CheckKeyExpiry(token2.OldKeyExpiry, expected); err != nil {
+				if dErr := b.discardS3Key(ctx, req.Storage, cfg, role.AccessZone, roleName); dErr != nil {
+					return nil, logical.CodedError(http.StatusBadGateway, fmt.Sprintf("Unable to issue credentials for user %s: %s. The issued key could not be discarded and expires at %s", roleName, err, time.Unix(int64(token2.OldKeyExpiry), 0).Format(time.RFC3339)))
+				}
+				return nil, logical.CodedError(http.StatusBadGateway, fmt.Sprintf("Unable to issue credentials for user %s: %s. The issued key has been discarded. Check that the clocks of Vault and the OneFS cluster are in sync", roleName, err))
+			}
 		}
 		kv["key_expiry"] = token2.OldKeyExpiry
 	}
@@ -0,0 +1,173 @@
+package vaultonefs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"time"
+)
+
+const (
+	pathMaintenanceHelpSynopsis    = "Pause credential issuance during cluster maintenance"
+	pathMaintenanceHelpDescription = `
+This endpoint enables or disables maintenance mode. While maintenance mode is enabled, requests for credentials
+return a 503 error with the configured message. Roles can still be managed and expired dynamic users are still
+cleaned up. With revocation_only set, role requests are rejected as well and only the cleanup of expired users
+continues. Automatic rotation of the root credentials is paused during maintenance.
+`
+)
+
+const (
+	apiPathMaintenance             string = "maintenance"
+	defaultPathMaintenanceMessage  string = "The OneFS secrets engine is in maintenance mode"
+	fieldMaintenanceEnabled        string = "enabled"
+	fieldMaintenanceMessage        string = "message"
+	fieldMaintenanceRevocationOnly string = "revocation_only"
+	fieldMaintenanceStarted        string = "started"
+	storagePathMaintenance         string = "maintenance"
+)
+
+// maintenanceCfg holds the maintenance mode state. The state is kept in replicated storage so that performance
+// secondaries that talk to the same OneFS cluster stop issuing credentials as well
+type maintenanceCfg struct {
+	Enabled        bool
+	Message        string
+	RevocationOnly bool
+	Started        time.Time
+}
+
+func pathMaintenanceBuild(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: apiPathMaintenance,
+			Fields: map[string]*framework.FieldSchema{
+				fieldMaintenanceEnabled: {
+					Type:        framework.TypeBool,
+					Default:     true,
+					Description: "Set to true to enable maintenance mode and false to disable it. Default is true.",
+				},
+				fieldMaintenanceMessage: {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("Message returned to clients while maintenance mode is enabled. If not set, '%s' will be used.", defaultPathMaintenanceMessage),
+				},
+				fieldMaintenanceRevocationOnly: {
+					Type:        framework.TypeBool,
+					Description: "Set to true to also reject requests for roles so that only the cleanup of expired users continues. Default is false.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{Callback: b.pathMaintenanceRead},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback:                    b.pathMaintenanceWrite,
+					ForwardPerformanceStandby:   true,
+					ForwardPerformanceSecondary: true,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback:                    b.pathMaintenanceDelete,
+					ForwardPerformanceStandby:   true,
+					ForwardPerformanceSecondary: true,
+				},
+			},
+			HelpSynopsis:    pathMaintenanceHelpSynopsis,
+			HelpDescription: pathMaintenanceHelpDescription,
+		},
+	}
+}
+
+func (b *backend) pathMaintenanceRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	maint, err := getMaintenanceFromStorage(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{Data: maint.responseData()}, nil
+}
+
+func (b *backend) pathMaintenanceWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	maint, err := getMaintenanceFromStorage(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	enabled := data.Get(fieldMaintenanceEnabled).(bool)
+	if enabled && !maint.Enabled {
+		maint.Started = time.Now()
+	}
+	maint.Enabled = enabled
+	message, ok := data.GetOk(fieldMaintenanceMessage)
+	if ok {
+		maint.Message = message.(string)
+	}
+	revocationOnly, ok := data.GetOk(fieldMaintenanceRevocationOnly)
+	if ok {
+		maint.RevocationOnly = revocationOnly.(bool)
+	}
+	if !maint.Enabled {
+		return b.pathMaintenanceDelete(ctx, req, data)
+	}
+	entry, err := logical.StorageEntryJSON(storagePathMaintenance, maint)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	b.Logger().Warn(fmt.Sprintf("Maintenance mode enabled: %s", maint.message()))
+	return &logical.Response{Data: maint.responseData()}, nil
+}
+
+// pathMaintenanceDelete disables maintenance mode
+func (b *backend) pathMaintenanceDelete(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, storagePathMaintenance); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("Maintenance mode disabled")
+	return nil, nil
+}
+
+// checkMaintenance returns a 503 error when maintenance mode is enabled. Requests that only manage roles are allowed
+// unless maintenance is limited to revocation
+func checkMaintenance(ctx context.Context, s logical.Storage, issuance bool) error {
+	maint, err := getMaintenanceFromStorage(ctx, s)
+	if err != nil {
+		return err
+	}
+	if !maint.Enabled || (!issuance && !maint.RevocationOnly) {
+		return nil
+	}
+	return logical.CodedError(http.StatusServiceUnavailable, maint.message())
+}
+
+// message returns the operator supplied message or the default message
+func (maint *maintenanceCfg) message() string {
+	if maint.Message != "" {
+		return maint.Message
+	}
+	return defaultPathMaintenanceMessage
+}
+
+func (maint *maintenanceCfg) responseData() map[string]interface{} {
+	return map[string]interface{}{
+		fieldMaintenanceEnabled:        maint.Enabled,
+		fieldMaintenanceMessage:        maint.Message,
+		fieldMaintenanceRevocationOnly: maint.RevocationOnly,
+		fieldMaintenanceStarted:        formatStatusTime(maint.Started),
+	}
+}
+
+// getMaintenanceFromStorage returns the maintenance mode state. A disabled state is returned when none is stored
+func getMaintenanceFromStorage(ctx context.Context, s logical.Storage) (*maintenanceCfg, error) {
+	data, err := s.Get(ctx, storagePathMaintenance)
+	if err != nil {
+		return nil, err
+	}
+	maint := &maintenanceCfg{}
+	if data == nil {
+		return maint, nil
+	}
+	if err := json.Unmarshal(data.Value, maint); err != nil {
+		return nil, err
+	}
+	return maint, nil
+}
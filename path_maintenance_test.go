@@ -0,0 +1,39 @@
+package vaultonefs
+
+import (
+	"context"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"testing"
+)
+
+func TestCheckMaintenance(t *testing.T) {
+	HelperCheckMaintenance(t, nil, true, 0)
+	HelperCheckMaintenance(t, &maintenanceCfg{Enabled: true}, true, http.StatusServiceUnavailable)
+	HelperCheckMaintenance(t, &maintenanceCfg{Enabled: true}, false, 0)
+	HelperCheckMaintenance(t, &maintenanceCfg{Enabled: true, RevocationOnly: true}, false, http.StatusServiceUnavailable)
+	HelperCheckMaintenance(t, &maintenanceCfg{Enabled: false, RevocationOnly: true}, false, 0)
+}
+
+func HelperCheckMaintenance(t *testing.T, maint *maintenanceCfg, issuance bool, expected int) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+	if maint != nil {
+		entry, _ := logical.StorageEntryJSON(storagePathMaintenance, maint)
+		if err := s.Put(ctx, entry); err != nil {
+			t.Fatalf("Unable to store maintenance state: %s", err)
+		}
+	}
+	x := 0
+	if err := checkMaintenance(ctx, s, issuance); err != nil {
+		coded, ok := err.(logical.HTTPCodedError)
+		if !ok {
+			t.Errorf("Maintenance: %+v, Issuance: %t, Expected a coded error, Got: %s", maint, issuance, err)
+			return
+		}
+		x = coded.Code()
+	}
+	if x != expected {
+		t.Errorf("Maintenance: %+v, Issuance: %t, Expected: %d, Got: %d", maint, issuance, expected, x)
+	}
+}
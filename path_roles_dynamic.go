@@ -27,6 +27,7 @@ const (
 	fieldPathRolesDynamicName            string = "name"
 	fieldPathRolesDynamicTTL             string = "ttl"
 	fieldPathRolesDynamicTTLMax          string = "ttl_max"
+	fieldPathRolesDynamicTTLMin          string = "ttl_min"
 )
 
 type s3Role struct {
@@ -35,6 +36,9 @@ type s3Role struct {
 	AccessZone string
 	TTL        int
 	TTLMax     int
+	TTLMin     int
+	// SchemaVersion is the version of the storage schema the role was written with
+	SchemaVersion int
 }
 
 func pathRolesDynamicBuild(b *backend) []*framework.Path {
@@ -59,12 +63,16 @@ func pathRolesDynamicBuild(b *backend) []*framework.Path {
 					Description: "Name of the role. The name should start and end with alphanumeric characters. Characters in the middle can be alphanumeric, . (period), or - (dash).",
 				},
 				fieldPathRolesDynamicTTL: {
-					Type:        framework.TypeInt,
-					Description: "Default credential duration in seconds. If not set or 0, plugin configuration will be used. If set to -1 no TTL will be used up to the plugin configuration.",
+					Type:        framework.TypeSignedDurationSecond,
+					Description: "Default credential duration as a duration such as 1h or a number of seconds. If not set or 0, plugin configuration will be used. If set to -1 the maximum TTL will be used.",
 				},
 				fieldPathRolesDynamicTTLMax: {
-					Type:        framework.TypeInt,
-					Description: "Maximum credential duration in seconds. If not set or 0, plugin configuration will be used. If set to -1, no TTL will be used up to the plugin configuration.",
+					Type:        framework.TypeSignedDurationSecond,
+					Description: "Maximum credential duration as a duration such as 24h or a number of seconds. If not set or 0, plugin configuration will be used. If set to -1, only the plugin configuration and the max lease TTL of the mount limit the TTL.",
+				},
+				fieldPathRolesDynamicTTLMin: {
+					Type:        framework.TypeDurationSecond,
+					Description: "Minimum credential duration as a duration such as 15m or a number of seconds. Requests that result in a shorter TTL are rejected. If not set or 0, no minimum is enforced.",
 				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -91,6 +99,9 @@ func pathRolesDynamicList(b *backend) []*framework.Path {
 }
 
 func (b *backend) pathRolesDynamicList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, false); err != nil {
+		return nil, err
+	}
 	roleList, err := req.Storage.List(ctx, apiPathRolesDynamic)
 	if err != nil {
 		return nil, err
@@ -99,6 +110,9 @@ func (b *backend) pathRolesDynamicList(ctx context.Context, req *logical.Request
 }
 
 func (b *backend) pathRolesDynamicWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, false); err != nil {
+		return nil, err
+	}
 	roleName := data.Get(fieldPathRolesDynamicName).(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Role name is missing"), nil
@@ -132,6 +146,10 @@ func (b *backend) pathRolesDynamicWrite(ctx context.Context, req *logical.Reques
 	if ok {
 		role.TTLMax = TTLMaxDuration.(int)
 	}
+	TTLMinDuration, ok := data.GetOk(fieldPathRolesDynamicTTLMin)
+	if ok {
+		role.TTLMin = TTLMinDuration.(int)
+	}
 	// Validate values
 	var validationErrors []string
 	if role.AccessZone == "" {
@@ -149,10 +167,34 @@ func (b *backend) pathRolesDynamicWrite(ctx context.Context, req *logical.Reques
 	if role.TTL < 0 {
 		role.TTL = -1
 	}
+	cfg, err := getCfgFromStorage(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		if err := cfg.CheckAccessZone(role.AccessZone); err != nil {
+			validationErrors = append(validationErrors, err.Error())
+		}
+		if err := cfg.CheckGroups(role.Groups); err != nil {
+			validationErrors = append(validationErrors, err.Error())
+		}
+		if err := cfg.CheckRoleTTL(role.TTL, role.TTLMax); err != nil {
+			validationErrors = append(validationErrors, err.Error())
+		}
+	}
+	if role.TTLMin > 0 {
+		if role.TTLMax > 0 && role.TTLMin > role.TTLMax {
+			validationErrors = append(validationErrors, "ttl_min must not be greater than ttl_max")
+		}
+		if role.TTL > 0 && role.TTL < role.TTLMin {
+			validationErrors = append(validationErrors, "ttl must not be less than ttl_min")
+		}
+	}
 
 	if len(validationErrors) > 0 {
 		return nil, fmt.Errorf("Validation errors for role: %s\n%s", roleName, strings.Join(validationErrors[:], "\n"))
 	}
+	role.SchemaVersion = storageSchemaVersion
 	// Format and store data on the backend server
 	entry, err := logical.StorageEntryJSON((apiPathRolesDynamic + roleName), role)
 	if err != nil {
@@ -164,15 +206,19 @@ func (b *backend) pathRolesDynamicWrite(ctx context.Context, req *logical.Reques
 	if err = req.Storage.Put(ctx, entry); err != nil {
 		return nil, err
 	}
+	b.clearCache(apiPathRolesDynamic + roleName)
 	return nil, nil
 }
 
 func (b *backend) pathRolesDynamicRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, false); err != nil {
+		return nil, err
+	}
 	roleName := data.Get(fieldPathRolesDynamicName).(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Unable to parse role name"), nil
 	}
-	role, err := getDynamicRoleFromStorage(ctx, req.Storage, roleName)
+	role, err := b.getDynamicRole(ctx, req.Storage, roleName)
 	if err != nil || role == nil {
 		return nil, err
 	}
@@ -182,6 +228,7 @@ func (b *backend) pathRolesDynamicRead(ctx context.Context, req *logical.Request
 		fieldPathRolesDynamicBucket:     role.Bucket,
 		fieldPathRolesDynamicGroup:      role.Groups,
 		fieldPathRolesDynamicTTL:        role.TTL,
+		fieldPathRolesDynamicTTLMin:     role.TTLMin,
 		fieldPathRolesDynamicTTLMax:     role.TTLMax,
 	}
 	return &logical.Response{Data: kv}, nil
@@ -189,6 +236,9 @@ func (b *backend) pathRolesDynamicRead(ctx context.Context, req *logical.Request
 
 // pathRolesDynamicDelete removes a role from the system
 func (b *backend) pathRolesDynamicDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, false); err != nil {
+		return nil, err
+	}
 	roleName := data.Get(fieldPathRolesDynamicName).(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Unable to parse role name"), nil
@@ -196,6 +246,7 @@ func (b *backend) pathRolesDynamicDelete(ctx context.Context, req *logical.Reque
 	if err := req.Storage.Delete(ctx, apiPathRolesDynamic+roleName); err != nil {
 		return nil, err
 	}
+	b.clearCache(apiPathRolesDynamic + roleName)
 	return nil, nil
 }
 
@@ -212,5 +263,6 @@ func getDynamicRoleFromStorage(ctx context.Context, s logical.Storage, roleName
 	if err := json.Unmarshal(data.Value, role); err != nil {
 		return nil, err
 	}
+	role.migrate()
 	return role, nil
 }
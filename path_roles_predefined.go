@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
 )
 
 const (
@@ -22,12 +23,16 @@ const (
 	fieldPathRolesPredefinedName            string = "name"
 	fieldPathRolesPredefinedTTL             string = "ttl"
 	fieldPathRolesPredefinedTTLMax          string = "ttl_max"
+	fieldPathRolesPredefinedTTLMin          string = "ttl_min"
 )
 
 type s3PredefinedRole struct {
 	AccessZone string
 	TTL        int
 	TTLMax     int
+	TTLMin     int
+	// SchemaVersion is the version of the storage schema the role was written with
+	SchemaVersion int
 }
 
 func pathRolesPredefinedBuild(b *backend) []*framework.Path {
@@ -44,12 +49,16 @@ func pathRolesPredefinedBuild(b *backend) []*framework.Path {
 					Description: "Name of the user. For local users the user name is should not contain an @. For Active Directory users, use the format username@domain.name. Characters in the middle can be alphanumeric, @, . (period), or - (dash).",
 				},
 				fieldPathRolesPredefinedTTL: {
-					Type:        framework.TypeInt,
-					Description: "Default credential duration in seconds. If not set or 0, plugin configuration will be used. If set to -1 no TTL will be used up to the plugin configuration.",
+					Type:        framework.TypeSignedDurationSecond,
+					Description: "Default credential duration as a duration such as 1h or a number of seconds. If not set or 0, plugin configuration will be used. If set to -1 the maximum TTL will be used.",
 				},
 				fieldPathRolesPredefinedTTLMax: {
-					Type:        framework.TypeInt,
-					Description: "Maximum credential duration in seconds. If not set or 0, plugin configuration will be used. If set to -1, no TTL will be used up to the plugin configuration.",
+					Type:        framework.TypeSignedDurationSecond,
+					Description: "Maximum credential duration as a duration such as 24h or a number of seconds. If not set or 0, plugin configuration will be used. If set to -1, only the plugin configuration and the max lease TTL of the mount limit the TTL.",
+				},
+				fieldPathRolesPredefinedTTLMin: {
+					Type:        framework.TypeDurationSecond,
+					Description: "Minimum credential duration as a duration such as 15m or a number of seconds. Requests that result in a shorter TTL are rejected. If not set or 0, no minimum is enforced.",
 				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -76,6 +85,9 @@ func pathRolesPredefinedList(b *backend) []*framework.Path {
 }
 
 func (b *backend) pathRolesPredefinedList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, false); err != nil {
+		return nil, err
+	}
 	roleList, err := req.Storage.List(ctx, apiPathRolesPredefined)
 	if err != nil {
 		return nil, err
@@ -84,6 +96,9 @@ func (b *backend) pathRolesPredefinedList(ctx context.Context, req *logical.Requ
 }
 
 func (b *backend) pathRolesPredefinedWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, false); err != nil {
+		return nil, err
+	}
 	roleName := data.Get(fieldPathRolesPredefinedName).(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Role name is missing"), nil
@@ -109,6 +124,10 @@ func (b *backend) pathRolesPredefinedWrite(ctx context.Context, req *logical.Req
 	if ok {
 		role.TTLMax = TTLMaxDuration.(int)
 	}
+	TTLMinDuration, ok := data.GetOk(fieldPathRolesPredefinedTTLMin)
+	if ok {
+		role.TTLMin = TTLMinDuration.(int)
+	}
 	// Validate values
 	if role.AccessZone == "" {
 		role.AccessZone = apiPathRolesPredefinedDefaultAccessZone
@@ -119,7 +138,32 @@ func (b *backend) pathRolesPredefinedWrite(ctx context.Context, req *logical.Req
 	if role.TTL < 0 {
 		role.TTL = -1
 	}
+	cfg, err := getCfgFromStorage(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	var validationErrors []string
+	if cfg != nil {
+		if err := cfg.CheckAccessZone(role.AccessZone); err != nil {
+			validationErrors = append(validationErrors, err.Error())
+		}
+		if err := cfg.CheckRoleTTL(role.TTL, role.TTLMax); err != nil {
+			validationErrors = append(validationErrors, err.Error())
+		}
+	}
+	if role.TTLMin > 0 {
+		if role.TTLMax > 0 && role.TTLMin > role.TTLMax {
+			validationErrors = append(validationErrors, "ttl_min must not be greater than ttl_max")
+		}
+		if role.TTL > 0 && role.TTL < role.TTLMin {
+			validationErrors = append(validationErrors, "ttl must not be less than ttl_min")
+		}
+	}
+	if len(validationErrors) > 0 {
+		return nil, fmt.Errorf("Validation errors for role: %s\n%s", roleName, strings.Join(validationErrors[:], "\n"))
+	}
 
+	role.SchemaVersion = storageSchemaVersion
 	// Format and store data on the backend server
 	entry, err := logical.StorageEntryJSON((apiPathRolesPredefined + roleName), role)
 	if err != nil {
@@ -131,15 +175,19 @@ func (b *backend) pathRolesPredefinedWrite(ctx context.Context, req *logical.Req
 	if err = req.Storage.Put(ctx, entry); err != nil {
 		return nil, err
 	}
+	b.clearCache(apiPathRolesPredefined + roleName)
 	return nil, nil
 }
 
 func (b *backend) pathRolesPredefinedRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, false); err != nil {
+		return nil, err
+	}
 	roleName := data.Get(fieldPathRolesPredefinedName).(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Unable to parse role name"), nil
 	}
-	role, err := getPredefinedRoleFromStorage(ctx, req.Storage, roleName)
+	role, err := b.getPredefinedRole(ctx, req.Storage, roleName)
 	if err != nil || role == nil {
 		return nil, err
 	}
@@ -147,6 +195,7 @@ func (b *backend) pathRolesPredefinedRead(ctx context.Context, req *logical.Requ
 	kv := map[string]interface{}{
 		fieldPathRolesPredefinedAccessZone: role.AccessZone,
 		fieldPathRolesPredefinedTTL:        role.TTL,
+		fieldPathRolesPredefinedTTLMin:     role.TTLMin,
 		fieldPathRolesPredefinedTTLMax:     role.TTLMax,
 	}
 	return &logical.Response{Data: kv}, nil
@@ -154,6 +203,9 @@ func (b *backend) pathRolesPredefinedRead(ctx context.Context, req *logical.Requ
 
 // pathRolesPredefinedDelete removes a role from the system
 func (b *backend) pathRolesPredefinedDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, false); err != nil {
+		return nil, err
+	}
 	roleName := data.Get(fieldPathRolesPredefinedName).(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Unable to parse role name"), nil
@@ -161,6 +213,7 @@ func (b *backend) pathRolesPredefinedDelete(ctx context.Context, req *logical.Re
 	if err := req.Storage.Delete(ctx, apiPathRolesPredefined+roleName); err != nil {
 		return nil, err
 	}
+	b.clearCache(apiPathRolesPredefined + roleName)
 	return nil, nil
 }
 
@@ -177,5 +230,6 @@ func getPredefinedRoleFromStorage(ctx context.Context, s logical.Storage, roleNa
 	if err := json.Unmarshal(data.Value, role); err != nil {
 		return nil, err
 	}
+	role.migrate()
 	return role, nil
 }
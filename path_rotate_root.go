@@ -0,0 +1,175 @@
+package vaultonefs
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	papi "github.com/murkyl/go-papi-lite"
+	"time"
+)
+
+const (
+	pathRotateRootHelpSynopsis    = "Rotate the password of the user configured in config/root"
+	pathRotateRootHelpDescription = `
+This endpoint generates a new password for the user configured in config/root, changes the password on the
+OneFS cluster and then stores the new password. If any step fails the old password is restored.
+If a password policy is configured the new password is generated from that policy.
+`
+)
+
+const (
+	apiPathRotateRoot                string = "rotate-root"
+	defaultPathRotateRootPasswordLen int    = 32
+)
+
+func pathRotateRootBuild(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: apiPathRotateRoot,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{Callback: b.pathRotateRootWrite, ForwardPerformanceStandby: true, ForwardPerformanceSecondary: true},
+			},
+			HelpSynopsis:    pathRotateRootHelpSynopsis,
+			HelpDescription: pathRotateRootHelpDescription,
+		},
+	}
+}
+
+func (b *backend) pathRotateRootWrite(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	if err := checkMaintenance(ctx, req.Storage, true); err != nil {
+		return nil, err
+	}
+	b.cfgLock.Lock()
+	defer b.cfgLock.Unlock()
+	cfg, err := getCfgFromStorage(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return logical.ErrorResponse("Plugin is not configured. Configure the plugin at the URL <plugin_path>/config/root"), nil
+	}
+	if err := b.rotateRootCredentials(ctx, req.Storage, cfg); err != nil {
+		return nil, b.papiClientError(err, "Unable to rotate the root credentials")
+	}
+	return nil, nil
+}
+
+// pluginPeriodRotateRoot rotates the root credentials when automatic rotation is enabled and the rotation period has
+// elapsed since the last rotation
+func (b *backend) pluginPeriodRotateRoot(ctx context.Context, s logical.Storage, cfg *backendCfg) {
+	if !rotationDue(cfg) {
+		return
+	}
+	// Storage on performance secondaries and standbys is read only so rotation is left to the primary
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby) {
+		return
+	}
+	// Rotation is postponed until maintenance of the cluster is over
+	if err := checkMaintenance(ctx, s, true); err != nil {
+		return
+	}
+	// The configuration is read again under the lock because it may have changed or been rotated since cfg was read
+	b.cfgLock.Lock()
+	defer b.cfgLock.Unlock()
+	cfg, err := getCfgFromStorage(ctx, s)
+	if err != nil || cfg == nil || !rotationDue(cfg) {
+		return
+	}
+	if err := b.rotateRootCredentials(ctx, s, cfg); err != nil {
+		b.Logger().Error(fmt.Sprintf("[pluginPeriodRotateRoot] Automatic rotation of root credentials failed: %s", err))
+	}
+}
+
+// rotationDue returns true when automatic rotation is enabled and the rotation period has elapsed
+func rotationDue(cfg *backendCfg) bool {
+	if cfg.RotationPeriod <= 0 {
+		return false
+	}
+	return !time.Now().Before(cfg.LastRotation.Add(time.Second * time.Duration(cfg.RotationPeriod)))
+}
+
+// rotateRootCredentials generates a new password for the configured user, changes the password on the cluster,
+// connects with the new password and finally stores the new password. A failure at any step restores the old
+// password on the cluster and leaves the stored configuration untouched
+// The caller must hold cfgLock and pass the configuration it read from storage while holding the lock
+func (b *backend) rotateRootCredentials(ctx context.Context, s logical.Storage, cfg *backendCfg) error {
+	newPassword, err := b.generateRootPassword(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to generate a new password: %s", err)
+	}
+	oldPassword := cfg.Password
+	err = b.papiDo(ctx, cfg, papiCallChange, func(conn *papi.OnefsConn) error {
+		return papiChangePassword(conn, cfg.User, oldPassword, newPassword)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to change the password for user %s: %s", cfg.User, err)
+	}
+
+	newCfg := *cfg
+	newCfg.Password = newPassword
+	newCfg.LastRotation = time.Now()
+	newConn := papi.NewPapiConn()
+	// Prefer the endpoint that is currently active before trying the remaining endpoints
+	_, activeEndpointIdx := b.papiSession.endpoint()
+	idx, err := connectEndpoints(ctx, newConn, &newCfg, EndpointOrderFrom(len(newCfg.EndpointList()), activeEndpointIdx))
+	if err != nil {
+		rbErr := b.rollbackRootPassword(ctx, &b.papiSession, &newCfg, oldPassword)
+		if rbErr != nil {
+			return fmt.Errorf("Unable to connect with the new password: %s. Rollback to the old password failed: %s", err, rbErr)
+		}
+		return fmt.Errorf("Unable to connect with the new password, the old password has been restored: %s", err)
+	}
+	// The write lock waits for calls using the old connection to finish before the connection is replaced
+	b.papiSession.lock.Lock()
+	oldConn := b.Conn
+	oldEndpoint := b.ActiveEndpoint
+	oldEndpointIdx := b.activeEndpointIdx
+	b.Conn = newConn
+	b.ActiveEndpoint = newCfg.EndpointList()[idx]
+	b.activeEndpointIdx = idx
+	b.generation++
+	b.papiSession.lock.Unlock()
+
+	entry, err := logical.StorageEntryJSON(apiPathConfigRoot, &newCfg)
+	if err == nil {
+		err = s.Put(ctx, entry)
+	}
+	if err != nil {
+		b.papiSession.lock.Lock()
+		b.Conn = oldConn
+		b.ActiveEndpoint = oldEndpoint
+		b.activeEndpointIdx = oldEndpointIdx
+		b.generation++
+		b.papiSession.lock.Unlock()
+		newSess := &papiSession{Conn: newConn, ActiveEndpoint: newCfg.EndpointList()[idx], activeEndpointIdx: idx}
+		rbErr := b.rollbackRootPassword(ctx, newSess, &newCfg, oldPassword)
+		newConn.Disconnect()
+		if rbErr != nil {
+			return fmt.Errorf("Unable to store the new password: %s. Rollback to the old password failed: %s", err, rbErr)
+		}
+		return fmt.Errorf("Unable to store the new password, the old password has been restored: %s", err)
+	}
+	b.clearCache(apiPathConfigRoot)
+	oldConn.Disconnect()
+	b.Logger().Info(fmt.Sprintf("Rotated the password for user %s", cfg.User))
+	return nil
+}
+
+// rollbackRootPassword changes the password back to the old password after a failed rotation. The cluster only
+// accepts the new password at this point so a session that has expired re-authenticates with newCfg
+func (b *backend) rollbackRootPassword(ctx context.Context, sess *papiSession, newCfg *backendCfg, oldPassword string) error {
+	return b.papiDoSession(ctx, sess, newCfg, papiCallChange, func(conn *papi.OnefsConn) error {
+		return papiChangePassword(conn, newCfg.User, newCfg.Password, oldPassword)
+	})
+}
+
+// generateRootPassword returns a new password using the configured Vault password policy or a random string when no
+// policy is configured
+func (b *backend) generateRootPassword(ctx context.Context, cfg *backendCfg) (string, error) {
+	if cfg.PasswordPolicy != "" {
+		return b.System().GeneratePasswordFromPolicy(ctx, cfg.PasswordPolicy)
+	}
+	return GenerateRandomString(defaultPathRotateRootPasswordLen)
+}
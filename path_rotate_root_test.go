@@ -0,0 +1,148 @@
+package vaultonefs
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failPutStorage is storage that rejects every write
+type failPutStorage struct {
+	*logical.InmemStorage
+}
+
+func (s *failPutStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	return fmt.Errorf("storage is read only")
+}
+
+func TestPluginPeriodRotateRootRereadsConfig(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	if err := b.Setup(ctx, logical.TestBackendConfig()); err != nil {
+		t.Fatalf("Unable to set up backend: %s", err)
+	}
+	s := &logical.InmemStorage{}
+	stored := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret", RotationPeriod: 3600, LastRotation: time.Now(), SchemaVersion: storageSchemaVersion}
+	entry, _ := logical.StorageEntryJSON(apiPathConfigRoot, stored)
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatalf("Unable to store config: %s", err)
+	}
+	// A configuration read before another rotation finished must not rotate the password again
+	stale := *stored
+	stale.LastRotation = time.Now().Add(-2 * time.Hour)
+	b.pluginPeriodRotateRoot(ctx, s, &stale)
+	if len(f.requests) != 0 || f.sessions != 0 {
+		t.Errorf("Expected no PAPI calls, Got: %v", f.requests)
+	}
+}
+
+func TestRotationDue(t *testing.T) {
+	HelperRotationDue(t, &backendCfg{RotationPeriod: 0}, false)
+	HelperRotationDue(t, &backendCfg{RotationPeriod: 3600, LastRotation: time.Now()}, false)
+	HelperRotationDue(t, &backendCfg{RotationPeriod: 3600, LastRotation: time.Now().Add(-2 * time.Hour)}, true)
+	HelperRotationDue(t, &backendCfg{RotationPeriod: 3600}, true)
+}
+
+func TestRotateRootCredentials(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePapi()
+	defer f.server.Close()
+	b, cfg, s := HelperRotateRootSetup(t, f)
+	oldConn := b.Conn
+	if err := b.rotateRootCredentials(ctx, s, cfg); err != nil {
+		t.Fatalf("Unable to rotate the root credentials: %s", err)
+	}
+	stored, err := getCfgFromStorage(ctx, s)
+	if err != nil || stored == nil {
+		t.Fatalf("Unable to read the stored config: %v", err)
+	}
+	if f.getPassword() == "secret" || stored.Password != f.getPassword() {
+		t.Errorf("Expected the stored password to match the new cluster password, Got: %s and %s", stored.Password, f.getPassword())
+	}
+	if stored.LastRotation.IsZero() {
+		t.Errorf("Expected the last rotation time to be stored")
+	}
+	if b.Conn == oldConn {
+		t.Errorf("Expected the connection to be replaced by a connection using the new password")
+	}
+}
+
+func TestRotateRootCredentialsRollback(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePapi()
+	defer f.server.Close()
+
+	// The new password is restored on the cluster when it cannot be stored
+	b, cfg, s := HelperRotateRootSetup(t, f)
+	oldConn := b.Conn
+	err := b.rotateRootCredentials(ctx, &failPutStorage{s}, cfg)
+	HelperRotateRootRollback(t, f, s, err, "old password has been restored")
+	if b.Conn != oldConn {
+		t.Errorf("Expected the connection with the old password to be kept")
+	}
+
+	// The new password is restored on the cluster when no session can be created with it
+	b, cfg, s = HelperRotateRootSetup(t, f)
+	f.setRejectLogins(true)
+	err = b.rotateRootCredentials(ctx, s, cfg)
+	f.setRejectLogins(false)
+	HelperRotateRootRollback(t, f, s, err, "old password has been restored")
+
+	// The session used for the rollback expired while connecting with the new password. It re-authenticates with the
+	// new password the cluster now accepts
+	b, cfg, s = HelperRotateRootSetup(t, f)
+	logins := 0
+	f.mu.Lock()
+	f.loginHook = func() bool {
+		logins++
+		if logins == 1 {
+			f.valid = map[string]bool{}
+			return true
+		}
+		return false
+	}
+	f.mu.Unlock()
+	err = b.rotateRootCredentials(ctx, s, cfg)
+	HelperRotateRootRollback(t, f, s, err, "old password has been restored")
+}
+
+func HelperRotationDue(t *testing.T, cfg *backendCfg, expected bool) {
+	if x := rotationDue(cfg); x != expected {
+		t.Errorf("Period: %d, Last rotation: %s, Expected: %t, Got: %t", cfg.RotationPeriod, cfg.LastRotation, expected, x)
+	}
+}
+
+// HelperRotateRootSetup stores a configuration for the fake cluster and connects a backend with it
+func HelperRotateRootSetup(t *testing.T, f *fakePapi) (*backend, *backendCfg, *logical.InmemStorage) {
+	ctx := context.Background()
+	b := newTestBackend()
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret"}
+	s := &logical.InmemStorage{}
+	entry, _ := logical.StorageEntryJSON(apiPathConfigRoot, cfg)
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatalf("Unable to store config: %s", err)
+	}
+	if err := papiConnect(ctx, b.Conn, cfg); err != nil {
+		t.Fatalf("Unable to connect to the fake cluster: %s", err)
+	}
+	return b, cfg, s
+}
+
+// HelperRotateRootRollback checks that a failed rotation left the old password on the cluster and in storage
+func HelperRotateRootRollback(t *testing.T, f *fakePapi, s logical.Storage, err error, expected string) {
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected an error containing '%s', Got: %v", expected, err)
+	}
+	if f.getPassword() != "secret" {
+		t.Errorf("Expected the old password to be restored on the cluster, Got: %s", f.getPassword())
+	}
+	stored, _ := getCfgFromStorage(context.Background(), s)
+	if stored == nil || stored.Password != "secret" {
+		t.Errorf("Expected the old password to stay in storage, Got: %+v", stored)
+	}
+}
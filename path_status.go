@@ -0,0 +1,240 @@
+package vaultonefs
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"time"
+)
+
+const (
+	pathStatusHelpSynopsis    = "Report the health of the connection to the OneFS cluster"
+	pathStatusHelpDescription = `
+This endpoint returns whether the plugin has a session to the OneFS cluster along with the cluster identity, the
+OneFS and PAPI versions detected when the plugin connected, the features supported by that version, the result of the last API calls, the number of PAPI operations in progress and queued when the number of concurrent operations is limited, the last user cleanup run and the number of configured roles per access zone.
+`
+)
+
+const (
+	apiPathStatus                string = "status"
+	fieldStatusActiveEndpoint    string = "active_endpoint"
+	fieldStatusCapabilities      string = "capabilities"
+	fieldStatusClusterGUID       string = "cluster_guid"
+	fieldStatusClusterName       string = "cluster_name"
+	fieldStatusConfigured        string = "configured"
+	fieldStatusConnected         string = "connected"
+	fieldStatusLastCleanup       string = "last_cleanup"
+	fieldStatusLastCleanupResult string = "last_cleanup_result"
+	fieldStatusLastError         string = "last_error"
+	fieldStatusLastErrorTime     string = "last_error_time"
+	fieldStatusLastSuccess       string = "last_success"
+	fieldStatusMaintenance       string = "maintenance"
+	fieldStatusNextCleanup       string = "next_cleanup"
+	fieldStatusOnefsVersion      string = "onefs_version"
+	fieldStatusPapiInFlight      string = "papi_in_flight"
+	fieldStatusPapiQueued        string = "papi_queued"
+	fieldStatusPapiVersion       string = "papi_version"
+	fieldStatusRoles             string = "roles"
+	statusCheckTimeout           int    = 5
+	statusErrorMaxLength         int    = 512
+	statusRoleModeDynamic        string = "dynamic"
+	statusRoleModePredefined     string = "predefined"
+)
+
+// backendStatus holds the results of recent PAPI calls and cleanup runs
+type backendStatus struct {
+	LastCleanup       time.Time
+	LastCleanupResult string
+	LastError         string
+	LastErrorTime     time.Time
+	LastSuccess       time.Time
+}
+
+// onefsClusterConfig is the subset of the cluster configuration returned by PAPI that is reported in the status
+type onefsClusterConfig struct {
+	GUID         string `json:"guid"`
+	Name         string `json:"name"`
+	OnefsVersion struct {
+		Release string `json:"release"`
+	} `json:"onefs_version"`
+}
+
+func pathStatusBuild(b *backend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: apiPathStatus,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{Callback: b.pathStatusRead},
+			},
+			HelpSynopsis:    pathStatusHelpSynopsis,
+			HelpDescription: pathStatusHelpDescription,
+		},
+	}
+}
+
+func (b *backend) pathStatusRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	cfg, err := b.getCfg(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := getRoleCounts(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	maint, err := getMaintenanceFromStorage(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	activeEndpoint, _ := b.papiSession.endpoint()
+	kv := map[string]interface{}{
+		fieldStatusActiveEndpoint: activeEndpoint,
+		fieldStatusMaintenance:    maint.responseData(),
+		fieldStatusConfigured:     cfg != nil,
+		fieldStatusConnected:      false,
+		fieldStatusRoles:          roles,
+	}
+	if cfg != nil {
+		if l := b.papiLimiterFor(cfg); l != nil {
+			kv[fieldStatusPapiInFlight], kv[fieldStatusPapiQueued] = l.usage()
+		}
+		kv[fieldStatusConnected] = b.papiSession.connected()
+		clusterCfg, err := b.statusClusterConfig(ctx)
+		if err == nil {
+			kv[fieldStatusClusterGUID] = clusterCfg.GUID
+			kv[fieldStatusClusterName] = clusterCfg.Name
+			kv[fieldStatusOnefsVersion] = clusterCfg.OnefsVersion.Release
+		}
+		kv[fieldStatusNextCleanup] = formatStatusTime(b.getNextCleanup())
+	}
+	cluster := b.getClusterInfo()
+	if cluster.PapiVersion != 0 {
+		kv[fieldStatusPapiVersion] = cluster.PapiVersion
+		kv[fieldStatusCapabilities] = Capabilities(cluster.PapiVersion)
+		if _, ok := kv[fieldStatusOnefsVersion]; !ok {
+			kv[fieldStatusOnefsVersion] = cluster.OnefsVersion
+		}
+	}
+	status := b.getStatus()
+	kv[fieldStatusLastCleanup] = formatStatusTime(status.LastCleanup)
+	kv[fieldStatusLastCleanupResult] = status.LastCleanupResult
+	kv[fieldStatusLastError] = status.LastError
+	kv[fieldStatusLastErrorTime] = formatStatusTime(status.LastErrorTime)
+	kv[fieldStatusLastSuccess] = formatStatusTime(status.LastSuccess)
+	return &logical.Response{Data: kv}, nil
+}
+
+// getStatus returns a copy of the results of recent PAPI calls and cleanup runs
+func (b *backend) getStatus() backendStatus {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	return b.Status
+}
+
+// getNextCleanup returns the time of the next cleanup of expired users
+func (b *backend) getNextCleanup() time.Time {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	return b.NextCleanup
+}
+
+// statusClusterConfig reads the cluster configuration over the current session of the user in config/root. The call
+// does not connect, retry, wait for a slot of the concurrency limiter or record its result so that polling the status
+// neither blocks under load nor hides a failing keep alive
+func (b *backend) statusClusterConfig(ctx context.Context) (*onefsClusterConfig, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(statusCheckTimeout)*time.Second)
+	defer cancel()
+	b.papiSession.lock.RLock()
+	defer b.papiSession.lock.RUnlock()
+	if b.Conn == nil || b.Conn.Papi.Client == nil {
+		return nil, fmt.Errorf("No session to the cluster")
+	}
+	return papiGetClusterConfig(papiWithContext(ctx, b.Conn))
+}
+
+// recordPapiResult updates the status with the result of a PAPI call. The status is returned to Vault clients so
+// only a sanitized description of the error is kept. The full error is returned to the caller
+func (b *backend) recordPapiResult(err error) {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if err != nil {
+		b.Status.LastError = statusErrorMessage(err)
+		b.Status.LastErrorTime = time.Now()
+		return
+	}
+	b.Status.LastSuccess = time.Now()
+}
+
+// statusErrorMessage returns the description of an error kept in the status. An error returned by the cluster is
+// reduced to the message of the first error in the response instead of the full response. Other errors, such as a
+// failed connection, are kept on a single line and truncated as they may list the error of every endpoint
+func statusErrorMessage(err error) string {
+	code, message := papiErrorStatus(err)
+	detail := err.Error()
+	if pErr := parsePapiError(err); pErr != nil {
+		detail = pErr.Message
+	}
+	detail = strings.Join(strings.Fields(detail), " ")
+	if len(detail) > statusErrorMaxLength {
+		detail = detail[:statusErrorMaxLength] + "..."
+	}
+	if detail == "" {
+		return fmt.Sprintf("%s (%d)", message, code)
+	}
+	return fmt.Sprintf("%s (%d): %s", message, code, detail)
+}
+
+// recordCleanup updates the status with the result of a cleanup run
+func (b *backend) recordCleanup(runTime time.Time, deleted int, errCount int, err error) {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	b.Status.LastCleanup = runTime
+	switch {
+	case err != nil:
+		b.Status.LastCleanupResult = fmt.Sprintf("Failed after deleting %d user(s): %s", deleted, err)
+	case errCount > 0:
+		b.Status.LastCleanupResult = fmt.Sprintf("Deleted %d user(s) with %d error(s)", deleted, errCount)
+	default:
+		b.Status.LastCleanupResult = fmt.Sprintf("Deleted %d user(s)", deleted)
+	}
+}
+
+// getRoleCounts returns the number of configured roles for each mode and access zone
+func getRoleCounts(ctx context.Context, s logical.Storage) (map[string]map[string]int, error) {
+	counts := map[string]map[string]int{
+		statusRoleModeDynamic:    {},
+		statusRoleModePredefined: {},
+	}
+	dynamicRoles, err := s.List(ctx, apiPathRolesDynamic)
+	if err != nil {
+		return nil, err
+	}
+	for _, roleName := range dynamicRoles {
+		role, err := getDynamicRoleFromStorage(ctx, s, roleName)
+		if err != nil || role == nil {
+			continue
+		}
+		counts[statusRoleModeDynamic][role.AccessZone]++
+	}
+	predefinedRoles, err := s.List(ctx, apiPathRolesPredefined)
+	if err != nil {
+		return nil, err
+	}
+	for _, roleName := range predefinedRoles {
+		role, err := getPredefinedRoleFromStorage(ctx, s, roleName)
+		if err != nil || role == nil {
+			continue
+		}
+		counts[statusRoleModePredefined][role.AccessZone]++
+	}
+	return counts, nil
+}
+
+// formatStatusTime returns a time in RFC 3339 format or an empty string when the time is not set
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,104 @@
+package vaultonefs
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathStatusRead(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePapi()
+	defer f.server.Close()
+	b := newTestBackend()
+	s := &logical.InmemStorage{}
+	// Without a configuration only the roles are reported
+	data := HelperPathStatusRead(t, b, s, false)
+	if data[fieldStatusConfigured] != false {
+		t.Errorf("Expected configured: false, Got: %v", data[fieldStatusConfigured])
+	}
+	cfg := &backendCfg{Endpoint: f.server.URL, User: "vault_mgr", Password: "secret", MaxConcurrentRequests: 1}
+	entry, _ := logical.StorageEntryJSON(apiPathConfigRoot, cfg)
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatalf("Unable to store config: %s", err)
+	}
+	role, _ := logical.StorageEntryJSON(apiPathRolesDynamic+"role1", &s3Role{AccessZone: "zone1"})
+	if err := s.Put(ctx, role); err != nil {
+		t.Fatalf("Unable to store role: %s", err)
+	}
+	// The status does not connect on its own
+	HelperPathStatusRead(t, b, s, false)
+	if err := b.connect(ctx, &b.papiSession, cfg); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	lastSuccess := time.Now().Add(-time.Hour)
+	b.Status = backendStatus{LastSuccess: lastSuccess}
+	// Reading the status does not need a slot of the concurrency limiter
+	_, release, err := b.acquirePapiSlot(ctx, cfg)
+	if err != nil {
+		t.Fatalf("Unable to acquire a slot: %s", err)
+	}
+	defer release()
+	data = HelperPathStatusRead(t, b, s, true)
+	if data[fieldStatusClusterName] != "cluster1" || data[fieldStatusOnefsVersion] != "9.5.0.0" {
+		t.Errorf("Unexpected cluster details: %v", data)
+	}
+	if roles := data[fieldStatusRoles].(map[string]map[string]int); roles[statusRoleModeDynamic]["zone1"] != 1 {
+		t.Errorf("Expected 1 dynamic role in zone1, Got: %v", roles)
+	}
+	// A failed check is not recorded and a successful one does not hide a failing keep alive. The session still
+	// exists so the plugin is reported as connected without the cluster details
+	f.expireSessions()
+	data = HelperPathStatusRead(t, b, s, true)
+	if _, ok := data[fieldStatusClusterName]; ok {
+		t.Errorf("Expected no cluster details for an expired session, Got: %v", data)
+	}
+	if status := b.getStatus(); !status.LastSuccess.Equal(lastSuccess) || status.LastError != "" {
+		t.Errorf("Expected the status check not to be recorded, Got: %+v", status)
+	}
+}
+
+func TestRecordPapiResult(t *testing.T) {
+	b := newTestBackend()
+	b.recordPapiResult(&papiResponseError{Status: 404, Body: testNotFoundBody})
+	HelperRecordPapiResult(t, b, "the object was not found on the OneFS cluster (404): Failed to find user for 'BadUser'")
+	b.recordPapiResult(fmt.Errorf("Unable to connect to any endpoint:\n%w", &papiConnError{Err: fmt.Errorf("dial tcp 10.0.0.1:8080: connect: connection refused\ndial tcp 10.0.0.2:8080: connect: connection refused")}))
+	HelperRecordPapiResult(t, b, "the OneFS cluster could not be reached (503): Unable to connect to any endpoint: dial tcp 10.0.0.1:8080: connect: connection refused dial tcp 10.0.0.2:8080: connect: connection refused")
+	b.recordPapiResult(fmt.Errorf("%s", strings.Repeat("x", 2*statusErrorMaxLength)))
+	if msg := b.getStatus().LastError; len(msg) > statusErrorMaxLength+100 {
+		t.Errorf("Expected a truncated error, Got %d characters", len(msg))
+	}
+	b.recordPapiResult(nil)
+	if b.getStatus().LastSuccess.IsZero() {
+		t.Errorf("Expected the time of the last success to be set")
+	}
+}
+
+func TestRecordCleanup(t *testing.T) {
+	b := newTestBackend()
+	runTime := time.Now()
+	b.recordCleanup(runTime, 2, 1, nil)
+	if status := b.getStatus(); !status.LastCleanup.Equal(runTime) || !strings.Contains(status.LastCleanupResult, "2 user(s) with 1 error(s)") {
+		t.Errorf("Unexpected cleanup status: %+v", status)
+	}
+}
+
+func HelperRecordPapiResult(t *testing.T, b *backend, expected string) {
+	if msg := b.getStatus().LastError; msg != expected {
+		t.Errorf("Expected the last error '%s', Got: '%s'", expected, msg)
+	}
+}
+
+func HelperPathStatusRead(t *testing.T, b *backend, s logical.Storage, connected bool) map[string]interface{} {
+	resp, err := b.pathStatusRead(context.Background(), &logical.Request{Storage: s}, nil)
+	if err != nil {
+		t.Fatalf("Unable to read status: %s", err)
+	}
+	if resp.Data[fieldStatusConnected] != connected {
+		t.Errorf("Expected connected: %t, Got: %v", connected, resp.Data[fieldStatusConnected])
+	}
+	return resp.Data
+}
@@ -0,0 +1,43 @@
+package vaultonefs
+
+import (
+	"fmt"
+)
+
+// onefsPrivilege describes an RBAC privilege required by the plugin
+type onefsPrivilege struct {
+	ID    string
+	Write bool
+}
+
+var (
+	// requiredPrivileges are needed for every mode of operation
+	requiredPrivileges = []onefsPrivilege{
+		{ID: "ISI_PRIV_LOGIN_PAPI", Write: false},
+		{ID: "ISI_PRIV_S3", Write: true},
+	}
+	// requiredDynamicPrivileges are needed in addition to requiredPrivileges when dynamic roles are used
+	requiredDynamicPrivileges = []onefsPrivilege{
+		{ID: "ISI_PRIV_AUTH", Write: true},
+	}
+)
+
+func (p onefsPrivilege) String() string {
+	if p.Write {
+		return fmt.Sprintf("%s (read/write)", p.ID)
+	}
+	return fmt.Sprintf("%s (read)", p.ID)
+}
+
+// MissingPrivileges returns the privileges from required that are not present in granted. A privilege granted with
+// read only access is considered missing when write access is required
+func MissingPrivileges(granted map[string]bool, required []onefsPrivilege) []string {
+	var missing []string
+	for _, priv := range required {
+		writable, ok := granted[priv.ID]
+		if !ok || (priv.Write && !writable) {
+			missing = append(missing, priv.String())
+		}
+	}
+	return missing
+}
@@ -0,0 +1,24 @@
+package vaultonefs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMissingPrivileges(t *testing.T) {
+	required := []onefsPrivilege{
+		{ID: "ISI_PRIV_LOGIN_PAPI", Write: false},
+		{ID: "ISI_PRIV_S3", Write: true},
+	}
+	HelperMissingPrivileges(t, map[string]bool{"ISI_PRIV_LOGIN_PAPI": false, "ISI_PRIV_S3": true}, required, nil)
+	HelperMissingPrivileges(t, map[string]bool{"ISI_PRIV_LOGIN_PAPI": true, "ISI_PRIV_S3": true}, required, nil)
+	HelperMissingPrivileges(t, map[string]bool{"ISI_PRIV_LOGIN_PAPI": false, "ISI_PRIV_S3": false}, required, []string{"ISI_PRIV_S3 (read/write)"})
+	HelperMissingPrivileges(t, map[string]bool{}, required, []string{"ISI_PRIV_LOGIN_PAPI (read)", "ISI_PRIV_S3 (read/write)"})
+}
+
+func HelperMissingPrivileges(t *testing.T, granted map[string]bool, required []onefsPrivilege, expected []string) {
+	x := MissingPrivileges(granted, required)
+	if !reflect.DeepEqual(x, expected) {
+		t.Errorf("Granted: %v, Expected: %v, Got: %v", granted, expected, x)
+	}
+}
@@ -0,0 +1,135 @@
+package vaultonefs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultDeniedGroups are groups that grant broad access on the cluster and may not be used by dynamic roles unless
+// denied_groups is changed. The domain admin entries match Active Directory groups in both the DOMAIN\group and
+// group@domain formats
+var defaultDeniedGroups = []string{
+	"Administrators",
+	"admin",
+	"wheel",
+	"*Domain Admins*",
+	"*Enterprise Admins*",
+	"*Schema Admins*",
+}
+
+// groupIDPrefixes are the prefixes OneFS accepts to name a group by its ID instead of its name. A group named by ID
+// cannot be checked against the denied and allowed groups, so it is rejected while either list is set
+var groupIDPrefixes = []string{"GID:", "UID:", "SID:"}
+
+// MatchPattern returns the first pattern that matches name. Patterns may contain the wildcards * and ? and are
+// matched without regard to case as OneFS names are not case sensitive. A backslash is matched literally so that
+// patterns can name groups in the DOMAIN\group format
+func MatchPattern(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(escapePattern(strings.ToLower(pattern)), strings.ToLower(name)); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// escapePattern escapes the backslashes in a pattern as path.Match would otherwise treat them as escape characters
+func escapePattern(pattern string) string {
+	return strings.ReplaceAll(pattern, `\`, `\\`)
+}
+
+// validatePatterns checks that every pattern in a list of wildcard patterns is well formed
+func validatePatterns(field string, patterns []string) []string {
+	var validationErrors []string
+	for _, pattern := range patterns {
+		if _, err := path.Match(escapePattern(pattern), ""); err != nil {
+			validationErrors = append(validationErrors, fmt.Sprintf("%s contains an invalid pattern '%s'", field, pattern))
+		}
+	}
+	return validationErrors
+}
+
+// groupBaseName returns the name of a group without the domain of the DOMAIN\group and group@domain formats
+func groupBaseName(group string) string {
+	if idx := strings.LastIndex(group, `\`); idx >= 0 {
+		return group[idx+1:]
+	}
+	if idx := strings.LastIndex(group, "@"); idx >= 0 {
+		return group[:idx]
+	}
+	return group
+}
+
+// CheckAccessZone returns an error when roles may not use an access zone. A denied access zone takes precedence over
+// the allowed access zones. When no allowed access zones are configured every access zone that is not denied is allowed
+func (cfg *backendCfg) CheckAccessZone(zoneName string) error {
+	if pattern, ok := MatchPattern(cfg.DeniedAccessZones, zoneName); ok {
+		return fmt.Errorf("Access zone %s is denied by '%s' in %s", zoneName, pattern, fieldConfigDeniedAccessZones)
+	}
+	if len(cfg.AllowedAccessZones) > 0 {
+		if _, ok := MatchPattern(cfg.AllowedAccessZones, zoneName); !ok {
+			return fmt.Errorf("Access zone %s is not in %s", zoneName, fieldConfigAllowedAccessZones)
+		}
+	}
+	return nil
+}
+
+// DeniedGroupList returns the groups that dynamic roles may not use. Configurations written before denied groups
+// could be configured use the default list
+func (cfg *backendCfg) DeniedGroupList() []string {
+	if cfg.DeniedGroups == nil {
+		return append([]string(nil), defaultDeniedGroups...)
+	}
+	return cfg.DeniedGroups
+}
+
+// CheckGroups returns an error listing every group that dynamic roles may not use. A denied group takes precedence
+// over the allowed groups. When no allowed groups are configured every group that is not denied is allowed
+func (cfg *backendCfg) CheckGroups(groups []string) error {
+	var problems []string
+	denied := cfg.DeniedGroupList()
+	for _, group := range groups {
+		if isGroupID(group) && (len(denied) > 0 || len(cfg.AllowedGroups) > 0) {
+			problems = append(problems, fmt.Sprintf("Group %s is named by ID and cannot be checked against %s and %s, use the group name", group, fieldConfigDeniedGroups, fieldConfigAllowedGroups))
+			continue
+		}
+		pattern, ok := MatchPattern(denied, group)
+		if !ok {
+			// A group with a domain is also denied by the patterns for the group name alone
+			pattern, ok = MatchPattern(denied, groupBaseName(group))
+		}
+		if ok {
+			problems = append(problems, fmt.Sprintf("Group %s is denied by '%s' in %s", group, pattern, fieldConfigDeniedGroups))
+			continue
+		}
+		if len(cfg.AllowedGroups) > 0 {
+			if _, ok := MatchPattern(cfg.AllowedGroups, group); !ok {
+				problems = append(problems, fmt.Sprintf("Group %s is not in %s", group, fieldConfigAllowedGroups))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// isGroupID returns true when a group is named by its GID, UID or SID
+func isGroupID(group string) bool {
+	for _, prefix := range groupIDPrefixes {
+		if strings.HasPrefix(strings.ToUpper(group), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRoleTTL returns an error when a role requests credentials that do not expire while unlimited TTLs are not
+// allowed. A value of 0 uses the plugin configuration and is always allowed
+func (cfg *backendCfg) CheckRoleTTL(TTL int, TTLMax int) error {
+	if !cfg.DenyUnlimitedTTL || (TTL >= 0 && TTLMax >= 0) {
+		return nil
+	}
+	return fmt.Errorf("ttl and ttl_max must not be -1 when %s is false in the plugin configuration", fieldConfigAllowUnlimitedTTL)
+}
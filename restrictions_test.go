@@ -0,0 +1,71 @@
+package vaultonefs
+
+import (
+	"testing"
+)
+
+func TestCheckAccessZone(t *testing.T) {
+	HelperCheckAccessZone(t, &backendCfg{}, "System", true)
+	HelperCheckAccessZone(t, &backendCfg{DeniedAccessZones: []string{"System"}}, "system", false)
+	HelperCheckAccessZone(t, &backendCfg{DeniedAccessZones: []string{"System"}}, "tenant1", true)
+	HelperCheckAccessZone(t, &backendCfg{AllowedAccessZones: []string{"tenant*"}}, "tenant1", true)
+	HelperCheckAccessZone(t, &backendCfg{AllowedAccessZones: []string{"tenant*"}}, "System", false)
+	HelperCheckAccessZone(t, &backendCfg{AllowedAccessZones: []string{"tenant?"}}, "tenant12", false)
+	HelperCheckAccessZone(t, &backendCfg{AllowedAccessZones: []string{"*"}, DeniedAccessZones: []string{"tenant1*"}}, "tenant12", false)
+	HelperCheckAccessZone(t, &backendCfg{AllowedAccessZones: []string{"*"}, DeniedAccessZones: []string{"tenant1*"}}, "tenant2", true)
+}
+
+func TestCheckGroups(t *testing.T) {
+	HelperCheckGroups(t, &backendCfg{}, []string{"Guests", "Backup Operators"}, true)
+	HelperCheckGroups(t, &backendCfg{}, []string{"Guests", "administrators"}, false)
+	HelperCheckGroups(t, &backendCfg{}, []string{"CORP\\Domain Admins"}, false)
+	HelperCheckGroups(t, &backendCfg{}, []string{"domain admins@corp.example.com"}, false)
+	HelperCheckGroups(t, &backendCfg{DeniedGroups: []string{}}, []string{"Administrators"}, true)
+	HelperCheckGroups(t, &backendCfg{AllowedGroups: []string{"s3-*"}}, []string{"s3-read", "s3-write"}, true)
+	HelperCheckGroups(t, &backendCfg{AllowedGroups: []string{"s3-*"}}, []string{"s3-read", "Guests"}, false)
+	HelperCheckGroups(t, &backendCfg{AllowedGroups: []string{"*"}}, []string{"wheel"}, false)
+	// Groups named by ID cannot be checked against the lists
+	HelperCheckGroups(t, &backendCfg{}, []string{"GID:0"}, false)
+	HelperCheckGroups(t, &backendCfg{}, []string{"sid:S-1-5-32-544"}, false)
+	HelperCheckGroups(t, &backendCfg{AllowedGroups: []string{"*"}, DeniedGroups: []string{}}, []string{"UID:0"}, false)
+	HelperCheckGroups(t, &backendCfg{DeniedGroups: []string{}}, []string{"GID:0"}, true)
+	// A group with a domain is denied by the patterns for the group name alone
+	HelperCheckGroups(t, &backendCfg{}, []string{"BUILTIN\\Administrators"}, false)
+	HelperCheckGroups(t, &backendCfg{}, []string{"wheel@corp.example.com"}, false)
+	// A backslash in a pattern matches the backslash of the DOMAIN\group format
+	HelperCheckGroups(t, &backendCfg{DeniedGroups: []string{"CORP\\s3-admins"}}, []string{"corp\\S3-Admins"}, false)
+	HelperCheckGroups(t, &backendCfg{DeniedGroups: []string{"CORP\\*"}}, []string{"CORP\\s3-read"}, false)
+	HelperCheckGroups(t, &backendCfg{DeniedGroups: []string{"CORP\\*"}}, []string{"OTHER\\s3-read"}, true)
+	HelperCheckGroups(t, &backendCfg{AllowedGroups: []string{"CORP\\s3-*"}}, []string{"CORP\\s3-read"}, true)
+}
+
+func TestDeniedGroupList(t *testing.T) {
+	// Changing the list of a configuration must not change the defaults
+	(&backendCfg{}).DeniedGroupList()[0] = "modified"
+	if defaultDeniedGroups[0] == "modified" {
+		t.Errorf("Expected the default denied groups to be unchanged")
+	}
+}
+
+func TestValidatePatterns(t *testing.T) {
+	if errs := validatePatterns(fieldConfigDeniedGroups, []string{"CORP\\*", "s3-?"}); len(errs) != 0 {
+		t.Errorf("Expected valid patterns, Got: %v", errs)
+	}
+	if errs := validatePatterns(fieldConfigDeniedGroups, []string{"[s3"}); len(errs) != 1 {
+		t.Errorf("Expected 1 invalid pattern, Got: %v", errs)
+	}
+}
+
+func HelperCheckAccessZone(t *testing.T, cfg *backendCfg, zoneName string, expected bool) {
+	err := cfg.CheckAccessZone(zoneName)
+	if (err == nil) != expected {
+		t.Errorf("Allowed: %v, Denied: %v, Zone: %s, Expected allowed: %t, Got: %v", cfg.AllowedAccessZones, cfg.DeniedAccessZones, zoneName, expected, err)
+	}
+}
+
+func HelperCheckGroups(t *testing.T, cfg *backendCfg, groups []string, expected bool) {
+	err := cfg.CheckGroups(groups)
+	if (err == nil) != expected {
+		t.Errorf("Allowed: %v, Denied: %v, Groups: %v, Expected allowed: %t, Got: %v", cfg.AllowedGroups, cfg.DeniedGroups, groups, expected, err)
+	}
+}
@@ -0,0 +1,99 @@
+package vaultonefs
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var fingerprintRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// certPinError is returned from the TLS handshake when the certificate presented by the endpoint does not match any
+// of the configured SHA-256 fingerprints
+type certPinError struct {
+	Fingerprint string
+}
+
+func (e *certPinError) Error() string {
+	return fmt.Sprintf("certificate fingerprint %s does not match any configured fingerprint", e.Fingerprint)
+}
+
+// NormalizeFingerprint takes a SHA-256 certificate fingerprint in hex format and returns it in lower case with any
+// colon or space separators removed. An error is returned if the result is not a valid SHA-256 fingerprint
+func NormalizeFingerprint(fp string) (string, error) {
+	normalized := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(fp)))
+	if !fingerprintRegexp.MatchString(normalized) {
+		return "", fmt.Errorf("Invalid SHA-256 certificate fingerprint: %s", fp)
+	}
+	return normalized, nil
+}
+
+// CertFingerprint returns the lower case hex SHA-256 fingerprint of a DER encoded certificate
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildTLSConfig creates the TLS configuration used for the PAPI connection from the plugin configuration
+func buildTLSConfig(cfg *backendCfg) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: cfg.BypassCert,
+		ServerName:         cfg.TLSServerName,
+	}
+	if cfg.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.CACert)) {
+			return nil, fmt.Errorf("Unable to parse any PEM encoded certificates from %s", fieldConfigCACert)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if len(cfg.CertFingerprints) > 0 {
+		pins := map[string]bool{}
+		for _, fp := range cfg.CertFingerprints {
+			normalized, err := NormalizeFingerprint(fp)
+			if err != nil {
+				return nil, err
+			}
+			pins[normalized] = true
+		}
+		// VerifyConnection is called after normal certificate verification and is also called when verification is
+		// bypassed. This allows a self-signed certificate to be pinned without trusting every certificate
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return &certPinError{Fingerprint: "<none>"}
+			}
+			fp := CertFingerprint(cs.PeerCertificates[0].Raw)
+			if !pins[fp] {
+				return &certPinError{Fingerprint: fp}
+			}
+			return nil
+		}
+	}
+	return tlsCfg, nil
+}
+
+// describeConnError returns an error that explains which TLS check failed when connecting to an endpoint. A failed
+// certificate check is not transient so it is not retried. Other errors are wrapped with the endpoint added for
+// context so that connection errors are still retried and failed over
+func describeConnError(err error, cfg *backendCfg) error {
+	var pinErr *certPinError
+	var authErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &pinErr):
+		return fmt.Errorf("TLS certificate pinning check failed for %s: %s. Update %s if the cluster certificate was replaced", cfg.Endpoint, pinErr, fieldConfigCertFingerprints)
+	case errors.As(err, &authErr):
+		return fmt.Errorf("TLS certificate authority check failed for %s: the certificate is not signed by a trusted CA. Provide the issuing CA in %s", cfg.Endpoint, fieldConfigCACert)
+	case errors.As(err, &hostErr):
+		return fmt.Errorf("TLS server name check failed for %s: %s. Set %s to a name contained in the certificate", cfg.Endpoint, hostErr.Error(), fieldConfigTLSServerName)
+	case errors.As(err, &invalidErr):
+		return fmt.Errorf("TLS certificate validity check failed for %s: %s", cfg.Endpoint, invalidErr.Error())
+	}
+	return fmt.Errorf("Unable to connect to endpoint %s: %w", cfg.Endpoint, err)
+}
@@ -0,0 +1,66 @@
+package vaultonefs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeFingerprint(t *testing.T) {
+	fp := "ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12"
+	HelperNormalizeFingerprint(t, fp, fp, false)
+	HelperNormalizeFingerprint(t, strings.ToUpper(fp), fp, false)
+	HelperNormalizeFingerprint(t, "AB:12:CD:34:EF:56:AB:12:CD:34:EF:56:AB:12:CD:34:EF:56:AB:12:CD:34:EF:56:AB:12:CD:34:EF:56:AB:12", fp, false)
+	HelperNormalizeFingerprint(t, fp[1:], "", true)
+	HelperNormalizeFingerprint(t, "zz"+fp[2:], "", true)
+}
+
+func TestCertPinning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	serverFP := CertFingerprint(server.Certificate().Raw)
+	otherFP := strings.Repeat("0", 64)
+
+	HelperCertPinning(t, server, &backendCfg{BypassCert: true}, "")
+	HelperCertPinning(t, server, &backendCfg{BypassCert: true, CertFingerprints: []string{serverFP}}, "")
+	HelperCertPinning(t, server, &backendCfg{BypassCert: true, CertFingerprints: []string{otherFP, serverFP}}, "")
+	HelperCertPinning(t, server, &backendCfg{BypassCert: true, CertFingerprints: []string{otherFP}}, "pinning")
+	HelperCertPinning(t, server, &backendCfg{}, "authority")
+}
+
+func HelperNormalizeFingerprint(t *testing.T, fp string, expected string, expectErr bool) {
+	x, err := NormalizeFingerprint(fp)
+	if (err != nil) != expectErr {
+		t.Errorf("Fingerprint: %s, Expected error: %t, Got: %v", fp, expectErr, err)
+	}
+	if x != expected {
+		t.Errorf("Fingerprint: %s, Expected: %s, Got: %s", fp, expected, x)
+	}
+}
+
+func HelperCertPinning(t *testing.T, server *httptest.Server, cfg *backendCfg, expectedErr string) {
+	cfg.Endpoint = server.URL
+	tlsCfg, err := buildTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("Unable to build TLS config: %s", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	resp, err := client.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if expectedErr == "" {
+		if err != nil {
+			t.Errorf("Fingerprints: %v, Expected success, Got: %s", cfg.CertFingerprints, err)
+		}
+		return
+	}
+	if err == nil {
+		t.Errorf("Fingerprints: %v, Expected %s error, Got success", cfg.CertFingerprints, expectedErr)
+		return
+	}
+	if msg := describeConnError(err, cfg).Error(); !strings.Contains(msg, expectedErr) {
+		t.Errorf("Fingerprints: %v, Expected %s error, Got: %s", cfg.CertFingerprints, expectedErr, msg)
+	}
+}
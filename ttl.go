@@ -1,8 +1,16 @@
 package vaultonefs
 
+import (
+	"fmt"
+	"time"
+)
+
 const (
 	// TTLTimeUnit is the default number of seconds a TTL should be a multiple
 	TTLTimeUnit int = 60
+	// strictTTLExpiryTolerance is the number of seconds the key expiry returned by OneFS may differ from the requested
+	// expiry in strict TTL mode. This allows for the time taken by the request and small clock differences
+	strictTTLExpiryTolerance int = 60
 )
 
 // RoundTTLToUnit takes an integer and rounds it to the nearest unit amount
@@ -19,6 +27,67 @@ func RoundTTLToUnit(TTL int, unit int) int {
 	return roundedTTL
 }
 
+// CalcTTLMinutes converts a TTL in seconds into a number of TTLTimeUnit units used as the S3 key expiry
+// A TTL of 0 or -1 results in a key that does not expire. When unlimited keys are not allowed the maximum TTL is used
+// instead. A positive TTL is never rounded down to 0 as that would create a key that does not expire. With roundUp
+// the TTL is rounded up to the next unit unless that would exceed the maximum TTL. An error is returned with roundUp
+// when the maximum TTL is shorter than a unit as every key would then outlive the maximum TTL
+func CalcTTLMinutes(TTLSeconds int, maxTTL int, allowUnlimited bool, roundUp bool) (int, error) {
+	if !allowUnlimited && TTLSeconds <= 0 {
+		TTLSeconds = maxTTL
+	}
+	if TTLSeconds <= 0 {
+		return TTLSeconds, nil // The TTL should be 0 or -1 which results in an infinite lease
+	}
+	TTLMinutes := RoundTTLToUnit(TTLSeconds, TTLTimeUnit) / TTLTimeUnit
+	if roundUp {
+		if maxTTL > 0 && maxTTL < TTLTimeUnit {
+			return 0, fmt.Errorf("The maximum TTL of %d seconds is shorter than the %d seconds S3 keys expire in at the least", maxTTL, TTLTimeUnit)
+		}
+		TTLMinutes = (TTLSeconds + TTLTimeUnit - 1) / TTLTimeUnit
+		if maxTTL > 0 && TTLMinutes*TTLTimeUnit > maxTTL {
+			TTLMinutes = maxTTL / TTLTimeUnit
+		}
+	}
+	if TTLMinutes == 0 {
+		TTLMinutes = 1
+	}
+	return TTLMinutes, nil
+}
+
+// CheckTTLMin returns an error when a TTL is shorter than the minimum TTL of a role. A minimum of 0 is not enforced and
+// an unlimited TTL is never shorter than the minimum
+func CheckTTLMin(TTLSeconds int, TTLMin int) error {
+	if TTLMin > 0 && TTLSeconds > 0 && TTLSeconds < TTLMin {
+		return fmt.Errorf("The TTL of %d seconds is shorter than the minimum TTL of %d seconds", TTLSeconds, TTLMin)
+	}
+	return nil
+}
+
+// CheckKeyExpiry returns an error when the expiry of an S3 key returned by OneFS, in seconds since the epoch, differs
+// from the expected expiry by more than strictTTLExpiryTolerance seconds
+func CheckKeyExpiry(expiry int, expected time.Time) error {
+	diff := int64(expiry) - expected.Unix()
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > int64(strictTTLExpiryTolerance) {
+		return fmt.Errorf("The key expires at %s instead of the requested %s", time.Unix(int64(expiry), 0).Format(time.RFC3339), expected.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CalcMountTTL returns the TTL for a credential and the maximum TTL that applies to it. The TTL cascade of the
+// request, role and plugin configuration is capped by the max lease TTL of the Vault mount. Vault always has a max
+// lease TTL so an unlimited TTL results in the max lease TTL of the mount. A mount max TTL of 0 is ignored
+func CalcMountTTL(requestedTTL int, roleTTL int, roleMaxTTL int, cfgTTL int, cfgMaxTTL int, mountMaxTTL int) (int, int) {
+	maxTTL := CalcMaxTTL(roleMaxTTL, cfgMaxTTL)
+	if mountMaxTTL > 0 {
+		maxTTL = GetLowerTTL(maxTTL, mountMaxTTL)
+	}
+	return CalcTTL(requestedTTL, roleTTL, cfgTTL, maxTTL), maxTTL
+}
+
 // CalcMaxTTL returns the lower TTL of 2 values
 // There are 2 special values for the TTL. -1 and 0
 // -1 represents an unlimited TTL
@@ -68,3 +137,8 @@ func GetLowerTTL(lower int, upper int) int {
 	}
 	return 0
 }
+
+// mountMaxTTL returns the max lease TTL of the mount in seconds
+func (b *backend) mountMaxTTL() int {
+	return int(b.System().MaxLeaseTTL().Seconds())
+}
@@ -2,6 +2,7 @@ package vaultonefs
 
 import (
 	"testing"
+	"time"
 )
 
 func TestCalcMaxTTL(t *testing.T) {
@@ -33,6 +34,78 @@ func TestCalcTTL(t *testing.T) {
 	HelperCalcTTL(t, 6000, 0, 300, -1, 6000)
 }
 
+func TestCalcMountTTL(t *testing.T) {
+	//                   Req  Role RoleMax Cfg CfgMax MountMax ExpectedTTL ExpectedMax
+	HelperCalcMountTTL(t, -1, 0, 0, 300, -1, 0, -1, -1)
+	HelperCalcMountTTL(t, -1, 0, 0, 300, -1, 86400, 86400, 86400)
+	HelperCalcMountTTL(t, 0, 0, 0, 300, -1, 86400, 300, 86400)
+	HelperCalcMountTTL(t, 0, 0, 0, -1, -1, 86400, 86400, 86400)
+	HelperCalcMountTTL(t, 0, -1, 0, 300, -1, 86400, 86400, 86400)
+	HelperCalcMountTTL(t, 0, -1, -1, -1, -1, 86400, 86400, 86400)
+	HelperCalcMountTTL(t, 7200, 0, 1800, 300, -1, 86400, 1800, 1800)
+	HelperCalcMountTTL(t, 172800, 0, 0, 300, 259200, 86400, 86400, 86400)
+}
+
+func HelperCalcMountTTL(t *testing.T, req int, role int, roleMax int, cfg int, cfgMax int, mountMax int, expectedTTL int, expectedMax int) {
+	x, y := CalcMountTTL(req, role, roleMax, cfg, cfgMax, mountMax)
+	if x != expectedTTL || y != expectedMax {
+		t.Errorf("Req: %d, Role: %d/%d, Cfg: %d/%d, Mount max: %d, Expected: %d/%d, Got: %d/%d", req, role, roleMax, cfg, cfgMax, mountMax, expectedTTL, expectedMax, x, y)
+	}
+}
+
+func TestCalcTTLMinutes(t *testing.T) {
+	//                     TTL  Max Unlimited RoundUp Expected
+	HelperCalcTTLMinutes(t, 300, -1, true, false, 5)
+	HelperCalcTTLMinutes(t, -1, -1, true, false, -1)
+	HelperCalcTTLMinutes(t, 0, 600, true, false, 0)
+	HelperCalcTTLMinutes(t, 20, -1, true, false, 1)
+	HelperCalcTTLMinutes(t, -1, 600, false, false, 10)
+	HelperCalcTTLMinutes(t, 0, 600, false, false, 10)
+	HelperCalcTTLMinutes(t, 10, 600, false, false, 1)
+	HelperCalcTTLMinutes(t, 150, 600, false, false, 2)
+	HelperCalcTTLMinutes(t, 150, 600, false, true, 3)
+	HelperCalcTTLMinutes(t, 61, -1, true, true, 2)
+	HelperCalcTTLMinutes(t, 90, 90, true, true, 1)
+	HelperCalcTTLMinutes(t, 20, 30, true, false, 1)
+	HelperCalcTTLMinutes(t, 100, 150, true, true, 2)
+	// Strict mode cannot issue a key that expires within a maximum TTL shorter than a unit
+	if _, err := CalcTTLMinutes(20, 30, true, true); err == nil {
+		t.Errorf("Expected an error for a maximum TTL shorter than %d seconds in strict mode", TTLTimeUnit)
+	}
+}
+
+func TestCheckTTLMin(t *testing.T) {
+	if CheckTTLMin(300, 600) == nil {
+		t.Errorf("Expected an error for a TTL shorter than the minimum")
+	}
+	if err := CheckTTLMin(600, 600); err != nil {
+		t.Errorf("Expected no error for a TTL equal to the minimum, Got: %s", err)
+	}
+	if err := CheckTTLMin(-1, 600); err != nil {
+		t.Errorf("Expected no error for an unlimited TTL, Got: %s", err)
+	}
+}
+
+func TestCheckKeyExpiry(t *testing.T) {
+	expected := time.Unix(1700000000, 0)
+	if err := CheckKeyExpiry(1700000030, expected); err != nil {
+		t.Errorf("Expected no error within the tolerance, Got: %s", err)
+	}
+	if CheckKeyExpiry(1700000000+3600, expected) == nil {
+		t.Errorf("Expected an error for an expiry an hour later")
+	}
+	if CheckKeyExpiry(0, expected) == nil {
+		t.Errorf("Expected an error for a key that does not expire")
+	}
+}
+
+func HelperCalcTTLMinutes(t *testing.T, TTLSeconds int, maxTTL int, allowUnlimited bool, roundUp bool, expected int) {
+	x, err := CalcTTLMinutes(TTLSeconds, maxTTL, allowUnlimited, roundUp)
+	if err != nil || x != expected {
+		t.Errorf("TTL: %d, Max: %d, Unlimited: %t, Round up: %t, Expected: %d, Got: %d %v", TTLSeconds, maxTTL, allowUnlimited, roundUp, expected, x, err)
+	}
+}
+
 func HelperCalcMaxTTL(t *testing.T, a int, b int, expected int) {
 	x := CalcMaxTTL(a, b)
 	if x != expected {
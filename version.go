@@ -1,3 +1,37 @@
 package vaultonefs
 
+import (
+	"runtime"
+)
+
 const PluginVersion string = "0.3.3"
+
+// storageSchemaVersion is the version of the layout of the entries the plugin keeps in Vault storage
+const storageSchemaVersion int = 2
+
+// BuildCommit and BuildDate are set at link time by the Makefile with -ldflags "-X ..."
+var (
+	BuildCommit string = "unknown"
+	BuildDate   string = "unknown"
+)
+
+// pluginModes lists the credential modes supported by the plugin
+var pluginModes = []string{statusRoleModeDynamic, statusRoleModePredefined}
+
+// pluginFeatures lists the optional features of the plugin so that tooling can tell what a mount supports
+var pluginFeatures = []string{
+	"access_zone_restrictions",
+	"certificate_pinning",
+	"endpoint_failover",
+	"group_restrictions",
+	"maintenance_mode",
+	"mount_ttl",
+	"root_rotation",
+	"strict_ttl",
+	"zone_service_accounts",
+}
+
+// GoVersion returns the version of Go used to build the plugin
+func GoVersion() string {
+	return runtime.Version()
+}